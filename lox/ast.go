@@ -0,0 +1,583 @@
+package lox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Node is an element of the syntax tree built by ParseAST. The bytecode
+// compiler is single-pass and never builds this tree; it exists so the
+// shape of a parse can be inspected.
+type Node interface {
+	// String renders the node as an S-expression.
+	String() string
+}
+
+type Program struct {
+	Statements []Node
+}
+
+type ExpressionStmt struct {
+	Expression Node
+}
+
+type PrintStmt struct {
+	Expression Node
+}
+
+type VarStmt struct {
+	Name        string
+	Initializer Node
+}
+
+type BlockStmt struct {
+	Statements []Node
+}
+
+type IfStmt struct {
+	Condition  Node
+	ThenBranch Node
+	ElseBranch Node
+}
+
+type WhileStmt struct {
+	Condition Node
+	Body      Node
+}
+
+type ForStmt struct {
+	Initializer Node
+	Condition   Node
+	Increment   Node
+	Body        Node
+}
+
+type ClassStmt struct {
+	Name       string
+	Superclass string
+	Methods    []*FunctionStmt
+}
+
+type FunctionStmt struct {
+	Name   string
+	Params []string
+	Body   []Node
+}
+
+type ReturnStmt struct {
+	Value Node
+}
+
+type BinaryExpr struct {
+	Operator string
+	Left     Node
+	Right    Node
+}
+
+type LogicalExpr struct {
+	Operator string
+	Left     Node
+	Right    Node
+}
+
+type UnaryExpr struct {
+	Operator string
+	Right    Node
+}
+
+type GroupingExpr struct {
+	Expression Node
+}
+
+type LiteralExpr struct {
+	Value Value
+}
+
+type VariableExpr struct {
+	Name string
+}
+
+type AssignExpr struct {
+	Name  string
+	Value Node
+}
+
+type ThisExpr struct{}
+
+type SuperExpr struct {
+	Method string
+}
+
+type GetExpr struct {
+	Object Node
+	Name   string
+}
+
+type SetExpr struct {
+	Object Node
+	Name   string
+	Value  Node
+}
+
+type CallExpr struct {
+	Callee    Node
+	Arguments []Node
+}
+
+func (node *Program) String() string {
+	return sexpr("program", node.Statements...)
+}
+
+func (node *ExpressionStmt) String() string {
+	return sexpr(";", node.Expression)
+}
+
+func (node *PrintStmt) String() string {
+	return sexpr("print", node.Expression)
+}
+
+func (node *VarStmt) String() string {
+	if node.Initializer == nil {
+		return fmt.Sprintf("(var %s)", node.Name)
+	}
+	return fmt.Sprintf("(var %s %s)", node.Name, node.Initializer)
+}
+
+func (node *BlockStmt) String() string {
+	return sexpr("block", node.Statements...)
+}
+
+func (node *IfStmt) String() string {
+	if node.ElseBranch == nil {
+		return sexpr("if", node.Condition, node.ThenBranch)
+	}
+	return sexpr("if", node.Condition, node.ThenBranch, node.ElseBranch)
+}
+
+func (node *WhileStmt) String() string {
+	return sexpr("while", node.Condition, node.Body)
+}
+
+func (node *ForStmt) String() string {
+	return sexpr("for", optional(node.Initializer), optional(node.Condition), optional(node.Increment), node.Body)
+}
+
+func (node *ClassStmt) String() string {
+	methods := make([]Node, len(node.Methods))
+	for i, method := range node.Methods {
+		methods[i] = method
+	}
+	head := "class " + node.Name
+	if node.Superclass != "" {
+		head += " < " + node.Superclass
+	}
+	return sexpr(head, methods...)
+}
+
+func (node *FunctionStmt) String() string {
+	return sexpr(fmt.Sprintf("fun %s (%s)", node.Name, strings.Join(node.Params, " ")), node.Body...)
+}
+
+func (node *ReturnStmt) String() string {
+	if node.Value == nil {
+		return "(return)"
+	}
+	return sexpr("return", node.Value)
+}
+
+func (node *BinaryExpr) String() string {
+	return sexpr(node.Operator, node.Left, node.Right)
+}
+
+func (node *LogicalExpr) String() string {
+	return sexpr(node.Operator, node.Left, node.Right)
+}
+
+func (node *UnaryExpr) String() string {
+	return sexpr(node.Operator, node.Right)
+}
+
+func (node *GroupingExpr) String() string {
+	return sexpr("group", node.Expression)
+}
+
+func (node *LiteralExpr) String() string {
+	if value, ok := node.Value.(StringValue); ok {
+		return fmt.Sprintf("%q", string(value))
+	}
+	return node.Value.String()
+}
+
+func (node *VariableExpr) String() string {
+	return node.Name
+}
+
+func (node *AssignExpr) String() string {
+	return fmt.Sprintf("(= %s %s)", node.Name, node.Value)
+}
+
+func (node *CallExpr) String() string {
+	return sexpr("call", append([]Node{node.Callee}, node.Arguments...)...)
+}
+
+func (node *ThisExpr) String() string {
+	return "this"
+}
+
+func (node *SuperExpr) String() string {
+	return fmt.Sprintf("(super %s)", node.Method)
+}
+
+func (node *GetExpr) String() string {
+	return fmt.Sprintf("(. %s %s)", node.Object, node.Name)
+}
+
+func (node *SetExpr) String() string {
+	return fmt.Sprintf("(= (. %s %s) %s)", node.Object, node.Name, node.Value)
+}
+
+func sexpr(head string, nodes ...Node) string {
+	var builder strings.Builder
+	builder.WriteString("(")
+	builder.WriteString(head)
+	for _, node := range nodes {
+		builder.WriteString(" ")
+		builder.WriteString(node.String())
+	}
+	builder.WriteString(")")
+	return builder.String()
+}
+
+// emptyNode stands in for an omitted for-loop clause when printing.
+type emptyNode struct{}
+
+func (emptyNode) String() string {
+	return "_"
+}
+
+func optional(node Node) Node {
+	if node == nil {
+		return emptyNode{}
+	}
+	return node
+}
+
+// ParseAST parses source into a syntax tree, returning the first syntax
+// error encountered.
+func ParseAST(source string) (Node, error) {
+	parser := &astParser{scanner: NewScanner(source)}
+	parser.advance()
+	program := &Program{}
+	for !parser.match(TokenEOF) {
+		program.Statements = append(program.Statements, parser.declaration())
+		if parser.err != nil {
+			return nil, parser.err
+		}
+	}
+	return program, nil
+}
+
+type astParser struct {
+	scanner  *Scanner
+	previous Token
+	current  Token
+	err      error
+}
+
+func (parser *astParser) advance() {
+	parser.previous = parser.current
+	parser.current = parser.scanner.ScanToken()
+	if parser.current.tokenType == TokenError {
+		parser.errorAt(parser.current, parser.current.lexeme)
+	}
+}
+
+func (parser *astParser) check(tokenType TokenType) bool {
+	return parser.current.tokenType == tokenType
+}
+
+func (parser *astParser) match(tokenType TokenType) bool {
+	if !parser.check(tokenType) {
+		return false
+	}
+	parser.advance()
+	return true
+}
+
+func (parser *astParser) consume(tokenType TokenType, message string) {
+	if parser.check(tokenType) {
+		parser.advance()
+		return
+	}
+	parser.errorAt(parser.current, message)
+}
+
+func (parser *astParser) errorAt(token Token, message string) {
+	if parser.err != nil {
+		return
+	}
+	switch token.tokenType {
+	case TokenEOF:
+		parser.err = fmt.Errorf("[line %d, col %d] Error at end: %s", token.line, token.column, message)
+	case TokenError:
+		parser.err = fmt.Errorf("[line %d, col %d] Error: %s", token.line, token.column, message)
+	default:
+		parser.err = fmt.Errorf("[line %d, col %d] Error at '%s': %s", token.line, token.column, token.lexeme, message)
+	}
+	// Stop parsing by pretending the input ended here.
+	parser.current = Token{tokenType: TokenEOF, line: token.line, column: token.column, start: token.start, end: token.start}
+}
+
+func (parser *astParser) declaration() Node {
+	if parser.match(TokenClass) {
+		return parser.classDeclaration()
+	}
+	if parser.match(TokenFun) {
+		return parser.funDeclaration()
+	}
+	if parser.match(TokenVar) {
+		return parser.varDeclaration()
+	}
+	return parser.statement()
+}
+
+func (parser *astParser) classDeclaration() Node {
+	parser.consume(TokenIdentifier, "Expect class name.")
+	stmt := &ClassStmt{Name: parser.previous.lexeme, Methods: make([]*FunctionStmt, 0)}
+	if parser.match(TokenLess) {
+		parser.consume(TokenIdentifier, "Expect superclass name.")
+		stmt.Superclass = parser.previous.lexeme
+	}
+	parser.consume(TokenLeftBrace, "Expect '{' before class body.")
+	for !parser.check(TokenRightBrace) && !parser.check(TokenEOF) {
+		parser.consume(TokenIdentifier, "Expect method name.")
+		stmt.Methods = append(stmt.Methods, parser.function())
+	}
+	parser.consume(TokenRightBrace, "Expect '}' after class body.")
+	return stmt
+}
+
+func (parser *astParser) funDeclaration() Node {
+	parser.consume(TokenIdentifier, "Expect function name.")
+	return parser.function()
+}
+
+// function parses a parameter list and body; the name has already been
+// consumed.
+func (parser *astParser) function() *FunctionStmt {
+	stmt := &FunctionStmt{Name: parser.previous.lexeme, Params: make([]string, 0)}
+	parser.consume(TokenLeftParen, "Expect '(' after function name.")
+	if !parser.check(TokenRightParen) {
+		for {
+			parser.consume(TokenIdentifier, "Expect parameter name.")
+			stmt.Params = append(stmt.Params, parser.previous.lexeme)
+			if !parser.match(TokenComma) {
+				break
+			}
+		}
+	}
+	parser.consume(TokenRightParen, "Expect ')' after parameters.")
+	parser.consume(TokenLeftBrace, "Expect '{' before function body.")
+	stmt.Body = parser.block()
+	return stmt
+}
+
+func (parser *astParser) varDeclaration() Node {
+	parser.consume(TokenIdentifier, "Expect variable name.")
+	stmt := &VarStmt{Name: parser.previous.lexeme}
+	if parser.match(TokenEqual) {
+		stmt.Initializer = parser.expression()
+	}
+	parser.consume(TokenSemicolon, "Expect ';' after variable declaration.")
+	return stmt
+}
+
+func (parser *astParser) statement() Node {
+	switch {
+	case parser.match(TokenPrint):
+		value := parser.expression()
+		parser.consume(TokenSemicolon, "Expect ';' after value.")
+		return &PrintStmt{value}
+	case parser.match(TokenIf):
+		return parser.ifStatement()
+	case parser.match(TokenReturn):
+		stmt := &ReturnStmt{}
+		if !parser.check(TokenSemicolon) {
+			stmt.Value = parser.expression()
+		}
+		parser.consume(TokenSemicolon, "Expect ';' after return value.")
+		return stmt
+	case parser.match(TokenWhile):
+		parser.consume(TokenLeftParen, "Expect '(' after 'while'.")
+		condition := parser.expression()
+		parser.consume(TokenRightParen, "Expect ')' after condition.")
+		return &WhileStmt{condition, parser.statement()}
+	case parser.match(TokenFor):
+		return parser.forStatement()
+	case parser.match(TokenLeftBrace):
+		return &BlockStmt{parser.block()}
+	default:
+		return parser.expressionStatement()
+	}
+}
+
+func (parser *astParser) expressionStatement() Node {
+	value := parser.expression()
+	parser.consume(TokenSemicolon, "Expect ';' after expression.")
+	return &ExpressionStmt{value}
+}
+
+func (parser *astParser) ifStatement() Node {
+	parser.consume(TokenLeftParen, "Expect '(' after 'if'.")
+	stmt := &IfStmt{Condition: parser.expression()}
+	parser.consume(TokenRightParen, "Expect ')' after condition.")
+	stmt.ThenBranch = parser.statement()
+	if parser.match(TokenElse) {
+		stmt.ElseBranch = parser.statement()
+	}
+	return stmt
+}
+
+func (parser *astParser) forStatement() Node {
+	stmt := &ForStmt{}
+	parser.consume(TokenLeftParen, "Expect '(' after 'for'.")
+	if parser.match(TokenSemicolon) {
+		// No initializer.
+	} else if parser.match(TokenVar) {
+		stmt.Initializer = parser.varDeclaration()
+	} else {
+		stmt.Initializer = parser.expressionStatement()
+	}
+	if !parser.match(TokenSemicolon) {
+		stmt.Condition = parser.expression()
+		parser.consume(TokenSemicolon, "Expect ';' after loop condition.")
+	}
+	if !parser.match(TokenRightParen) {
+		stmt.Increment = parser.expression()
+		parser.consume(TokenRightParen, "Expect ')' after for clauses.")
+	}
+	stmt.Body = parser.statement()
+	return stmt
+}
+
+func (parser *astParser) block() []Node {
+	statements := make([]Node, 0)
+	for !parser.check(TokenRightBrace) && !parser.check(TokenEOF) {
+		statements = append(statements, parser.declaration())
+	}
+	parser.consume(TokenRightBrace, "Expect '}' after block.")
+	return statements
+}
+
+func (parser *astParser) expression() Node {
+	return parser.parsePrecedence(PrecedenceAssignment)
+}
+
+// parsePrecedence mirrors the compiler's Pratt parser so both front-ends
+// agree on precedence and associativity.
+func (parser *astParser) parsePrecedence(precedence Precedence) Node {
+	parser.advance()
+	canAssign := precedence <= PrecedenceAssignment
+	left := parser.prefix(canAssign)
+	for left != nil && precedence <= astPrecedence(parser.current.tokenType) {
+		parser.advance()
+		left = parser.infix(left, canAssign)
+	}
+	if canAssign && parser.match(TokenEqual) {
+		parser.errorAt(parser.previous, "Invalid assignment target.")
+	}
+	if left == nil {
+		return emptyNode{}
+	}
+	return left
+}
+
+func (parser *astParser) prefix(canAssign bool) Node {
+	token := parser.previous
+	switch token.tokenType {
+	case TokenLeftParen:
+		inner := parser.expression()
+		parser.consume(TokenRightParen, "Expect ')' after expression.")
+		return &GroupingExpr{inner}
+	case TokenMinus, TokenBang:
+		return &UnaryExpr{token.lexeme, parser.parsePrecedence(PrecedenceUnary)}
+	case TokenNumber:
+		return &LiteralExpr{parseNumber(token.lexeme)}
+	case TokenString:
+		return &LiteralExpr{StringValue(token.lexeme[1 : len(token.lexeme)-1])}
+	case TokenTrue:
+		return &LiteralExpr{BoolValue(true)}
+	case TokenFalse:
+		return &LiteralExpr{BoolValue(false)}
+	case TokenNil:
+		return &LiteralExpr{Nil}
+	case TokenThis:
+		return &ThisExpr{}
+	case TokenSuper:
+		parser.consume(TokenDot, "Expect '.' after 'super'.")
+		parser.consume(TokenIdentifier, "Expect superclass method name.")
+		return &SuperExpr{parser.previous.lexeme}
+	case TokenIdentifier:
+		if canAssign && parser.match(TokenEqual) {
+			return &AssignExpr{token.lexeme, parser.expression()}
+		}
+		return &VariableExpr{token.lexeme}
+	}
+	parser.errorAt(token, "Expect expression.")
+	return nil
+}
+
+func (parser *astParser) infix(left Node, canAssign bool) Node {
+	operator := parser.previous
+	precedence := astPrecedence(operator.tokenType)
+	switch operator.tokenType {
+	case TokenLeftParen:
+		call := &CallExpr{Callee: left, Arguments: make([]Node, 0)}
+		if !parser.check(TokenRightParen) {
+			for {
+				call.Arguments = append(call.Arguments, parser.expression())
+				if !parser.match(TokenComma) {
+					break
+				}
+			}
+		}
+		parser.consume(TokenRightParen, "Expect ')' after arguments.")
+		return call
+	case TokenDot:
+		parser.consume(TokenIdentifier, "Expect property name after '.'.")
+		name := parser.previous.lexeme
+		if canAssign && parser.match(TokenEqual) {
+			return &SetExpr{left, name, parser.expression()}
+		}
+		return &GetExpr{left, name}
+	case TokenAnd, TokenOr:
+		return &LogicalExpr{operator.lexeme, left, parser.parsePrecedence(precedence)}
+	case TokenStarStar:
+		return &BinaryExpr{operator.lexeme, left, parser.parsePrecedence(precedence)}
+	default:
+		return &BinaryExpr{operator.lexeme, left, parser.parsePrecedence(precedence + 1)}
+	}
+}
+
+func astPrecedence(tokenType TokenType) Precedence {
+	switch tokenType {
+	case TokenLeftParen, TokenDot:
+		return PrecedenceCall
+	case TokenOr:
+		return PrecedenceOr
+	case TokenAnd:
+		return PrecedenceAnd
+	case TokenEqualEqual, TokenBangEqual:
+		return PrecedenceEquality
+	case TokenGreater, TokenGreaterEqual, TokenLess, TokenLessEqual:
+		return PrecedenceComparison
+	case TokenPlus, TokenMinus:
+		return PrecedenceTerm
+	case TokenStar, TokenSlash, TokenPercent:
+		return PrecedenceFactor
+	case TokenStarStar:
+		return PrecedenceExponent
+	default:
+		return PrecedenceNone
+	}
+}
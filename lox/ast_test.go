@@ -0,0 +1,62 @@
+package lox
+
+import "testing"
+
+func TestParseASTPrecedence(t *testing.T) {
+	node, err := ParseAST("1 + 2 * 3;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := node.(*Program)
+	if len(program.Statements) != 1 {
+		t.Fatalf("parsed %d statements, want 1", len(program.Statements))
+	}
+	sum, ok := program.Statements[0].(*ExpressionStmt).Expression.(*BinaryExpr)
+	if !ok || sum.Operator != "+" {
+		t.Fatalf("top node is %s, want a '+'", program.Statements[0])
+	}
+	if left, ok := sum.Left.(*LiteralExpr); !ok || left.Value != IntValue(1) {
+		t.Errorf("left operand is %s, want 1", sum.Left)
+	}
+	product, ok := sum.Right.(*BinaryExpr)
+	if !ok || product.Operator != "*" {
+		t.Fatalf("right operand is %s, want a '*'", sum.Right)
+	}
+	if product.Left.String() != "2" || product.Right.String() != "3" {
+		t.Errorf("product is %s, want (* 2 3)", product)
+	}
+}
+
+func TestParseASTString(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"1 + 2 * 3;", "(program (; (+ 1 (* 2 3))))"},
+		{"(1 + 2) * 3;", "(program (; (* (group (+ 1 2)) 3)))"},
+		{"1 - 2 - 3;", "(program (; (- (- 1 2) 3)))"},
+		{"a = b = -1;", "(program (; (= a (= b (- 1)))))"},
+		{"print !true == false;", "(program (print (== (! true) false)))"},
+		{"var s = \"hi\"; { var n; }", "(program (var s \"hi\") (block (var n)))"},
+	}
+	for _, test := range tests {
+		node, err := ParseAST(test.source)
+		if err != nil {
+			t.Errorf("ParseAST(%q) = %v", test.source, err)
+			continue
+		}
+		if node.String() != test.want {
+			t.Errorf("ParseAST(%q) = %s, want %s", test.source, node, test.want)
+		}
+	}
+}
+
+func TestParseASTError(t *testing.T) {
+	_, err := ParseAST("print 1 +;\nprint 2")
+	if err == nil || err.Error() != "[line 1, col 10] Error at ';': Expect expression." {
+		t.Errorf("ParseAST() = %v, want the first syntax error", err)
+	}
+	if _, err := ParseAST("1 = 2;"); err == nil || err.Error() != "[line 1, col 3] Error at '=': Invalid assignment target." {
+		t.Errorf("ParseAST() = %v for an invalid assignment", err)
+	}
+}
@@ -1,5 +1,7 @@
 package lox
 
+import "fmt"
+
 type OpCode int
 
 const (
@@ -30,8 +32,115 @@ const (
 	OpJumpIfFalse
 	OpJump
 	OpLoop
+	OpGetLocalLong
+	OpSetLocalLong
+	OpImmediate
+	OpModulo
+	OpExponent
+	OpCall
+	OpClosure
+	OpGetUpvalue
+	OpSetUpvalue
+	OpCloseUpvalue
+	OpClass
+	OpGetProperty
+	OpSetProperty
+	OpMethod
+	OpInherit
+	OpGetSuper
+	OpConstantLong
+	OpConcat
+	OpDefineGlobalLong
+	OpGetGlobalLong
+	OpSetGlobalLong
+	OpClosureLong
+	OpClassLong
+	OpGetPropertyLong
+	OpSetPropertyLong
+	OpMethodLong
+	OpGetSuperLong
 )
 
+var opNames = [...]string{
+	OpReturn:       "OP_RETURN",
+	OpConstant:     "OP_CONSTANT",
+	OpNegate:       "OP_NEGATE",
+	OpAdd:          "OP_ADD",
+	OpSubtract:     "OP_SUBTRACT",
+	OpMultiply:     "OP_MULTIPLY",
+	OpDivide:       "OP_DIVIDE",
+	OpNil:          "OP_NIL",
+	OpTrue:         "OP_TRUE",
+	OpFalse:        "OP_FALSE",
+	OpNot:          "OP_NOT",
+	OpEqual:        "OP_EQUAL",
+	OpNotEqual:     "OP_NOT_EQUAL",
+	OpGreater:      "OP_GREATER",
+	OpGreaterEqual: "OP_GREATER_EQUAL",
+	OpLess:         "OP_LESS",
+	OpLessEqual:    "OP_LESS_EQUAL",
+	OpPrint:        "OP_PRINT",
+	OpPop:          "OP_POP",
+	OpDefineGlobal: "OP_DEFINE_GLOBAL",
+	OpGetGlobal:    "OP_GET_GLOBAL",
+	OpSetGlobal:    "OP_SET_GLOBAL",
+	OpGetLocal:     "OP_GET_LOCAL",
+	OpSetLocal:     "OP_SET_LOCAL",
+	OpJumpIfFalse:  "OP_JUMP_IF_FALSE",
+	OpJump:         "OP_JUMP",
+	OpLoop:         "OP_LOOP",
+	OpGetLocalLong: "OP_GET_LOCAL_LONG",
+	OpSetLocalLong: "OP_SET_LOCAL_LONG",
+	OpImmediate:    "OP_IMMEDIATE",
+	OpModulo:       "OP_MODULO",
+	OpExponent:     "OP_EXPONENT",
+	OpCall:         "OP_CALL",
+	OpClosure:      "OP_CLOSURE",
+	OpGetUpvalue:   "OP_GET_UPVALUE",
+	OpSetUpvalue:   "OP_SET_UPVALUE",
+	OpCloseUpvalue: "OP_CLOSE_UPVALUE",
+	OpClass:        "OP_CLASS",
+	OpGetProperty:  "OP_GET_PROPERTY",
+	OpSetProperty:  "OP_SET_PROPERTY",
+	OpMethod:       "OP_METHOD",
+	OpInherit:      "OP_INHERIT",
+	OpGetSuper:     "OP_GET_SUPER",
+	OpConstantLong: "OP_CONSTANT_LONG",
+	OpConcat:       "OP_CONCAT",
+
+	OpDefineGlobalLong: "OP_DEFINE_GLOBAL_LONG",
+	OpGetGlobalLong:    "OP_GET_GLOBAL_LONG",
+	OpSetGlobalLong:    "OP_SET_GLOBAL_LONG",
+	OpClosureLong:      "OP_CLOSURE_LONG",
+	OpClassLong:        "OP_CLASS_LONG",
+	OpGetPropertyLong:  "OP_GET_PROPERTY_LONG",
+	OpSetPropertyLong:  "OP_SET_PROPERTY_LONG",
+	OpMethodLong:       "OP_METHOD_LONG",
+	OpGetSuperLong:     "OP_GET_SUPER_LONG",
+}
+
+// longForms maps each instruction whose operand is a one-byte constant
+// index to its _LONG form, which takes a 24-bit index instead.
+var longForms = map[OpCode]OpCode{
+	OpConstant:     OpConstantLong,
+	OpDefineGlobal: OpDefineGlobalLong,
+	OpGetGlobal:    OpGetGlobalLong,
+	OpSetGlobal:    OpSetGlobalLong,
+	OpClosure:      OpClosureLong,
+	OpClass:        OpClassLong,
+	OpGetProperty:  OpGetPropertyLong,
+	OpSetProperty:  OpSetPropertyLong,
+	OpMethod:       OpMethodLong,
+	OpGetSuper:     OpGetSuperLong,
+}
+
+func (op OpCode) String() string {
+	if op < 0 || int(op) >= len(opNames) {
+		return fmt.Sprintf("OP_UNKNOWN(%d)", int(op))
+	}
+	return opNames[op]
+}
+
 type Chunk struct {
 	code      []byte
 	constants []Value
@@ -55,3 +164,182 @@ func (chunk *Chunk) AddConstant(value Value) int {
 	chunk.constants = append(chunk.constants, value)
 	return len(chunk.constants) - 1
 }
+
+// operandCount returns how many fixed operand bytes follow the given
+// opcode, or -1 if the opcode is unknown. OP_CLOSURE and OP_CLOSURE_LONG
+// are additionally followed by two bytes per captured upvalue; see
+// instructionSize.
+func operandCount(op OpCode) int {
+	switch op {
+	case OpConstant, OpDefineGlobal, OpGetGlobal, OpSetGlobal, OpGetLocal, OpSetLocal, OpImmediate,
+		OpCall, OpClosure, OpGetUpvalue, OpSetUpvalue, OpClass, OpGetProperty, OpSetProperty,
+		OpMethod, OpGetSuper:
+		return 1
+	case OpJumpIfFalse, OpJump, OpLoop, OpGetLocalLong, OpSetLocalLong:
+		return 2
+	case OpConstantLong, OpDefineGlobalLong, OpGetGlobalLong, OpSetGlobalLong, OpClosureLong, OpClassLong,
+		OpGetPropertyLong, OpSetPropertyLong, OpMethodLong, OpGetSuperLong:
+		return 3
+	case OpReturn, OpNegate, OpAdd, OpSubtract, OpMultiply, OpDivide, OpNil, OpTrue, OpFalse,
+		OpNot, OpEqual, OpNotEqual, OpGreater, OpGreaterEqual, OpLess, OpLessEqual, OpPrint, OpPop,
+		OpModulo, OpExponent, OpCloseUpvalue, OpInherit, OpConcat:
+		return 0
+	default:
+		return -1
+	}
+}
+
+// instructionSize returns the total length in bytes of the instruction
+// at offset, or -1 if its opcode is unknown.
+func (chunk *Chunk) instructionSize(offset int) int {
+	op := OpCode(chunk.code[offset])
+	operands := operandCount(op)
+	if operands == -1 {
+		return -1
+	}
+	if op == OpClosure || op == OpClosureLong {
+		index, _ := chunk.constantOperand(offset)
+		if function, ok := chunk.constants[index].(*FunctionValue); ok {
+			operands += 2 * function.upvalueCount
+		}
+	}
+	return 1 + operands
+}
+
+// Validate walks the bytecode and reports the first malformed instruction:
+// unknown opcodes, truncated operands, out-of-range constant and upvalue
+// indices and jumps that don't land on an instruction boundary.
+func (chunk *Chunk) Validate() error {
+	return chunk.validate(0)
+}
+
+// validate checks the chunk of a function with the given number of
+// upvalues; the top-level script has none.
+func (chunk *Chunk) validate(upvalueCount int) error {
+	if len(chunk.lines) != len(chunk.code) {
+		return fmt.Errorf("line table has %d entries for %d bytes of code", len(chunk.lines), len(chunk.code))
+	}
+	if len(chunk.code) == 0 {
+		return fmt.Errorf("empty chunk")
+	}
+
+	starts := make(map[int]bool)
+	var jumps [][2]int
+	lastOp := OpReturn
+	for offset := 0; offset < len(chunk.code); {
+		op := OpCode(chunk.code[offset])
+		operands := operandCount(op)
+		if operands == -1 {
+			return fmt.Errorf("unknown opcode %d at offset %d", int(op), offset)
+		}
+		if offset+operands >= len(chunk.code) {
+			return fmt.Errorf("truncated operand for %s at offset %d", op, offset)
+		}
+		starts[offset] = true
+
+		if index, ok := chunk.constantOperand(offset); ok {
+			if index >= len(chunk.constants) {
+				return fmt.Errorf("constant index %d out of range at offset %d", index, offset)
+			}
+			switch op {
+			case OpConstant, OpConstantLong:
+			case OpClosure, OpClosureLong:
+				if _, ok := chunk.constants[index].(*FunctionValue); !ok {
+					return fmt.Errorf("closure at offset %d does not refer to a function", offset)
+				}
+			default:
+				if _, ok := chunk.constants[index].(StringValue); !ok {
+					return fmt.Errorf("global name at offset %d is not a string", offset)
+				}
+			}
+		}
+
+		switch op {
+		case OpGetUpvalue, OpSetUpvalue:
+			if index := int(chunk.code[offset+1]); index >= upvalueCount {
+				return fmt.Errorf("upvalue index %d out of range at offset %d", index, offset)
+			}
+		case OpJumpIfFalse, OpJump, OpLoop:
+			jumps = append(jumps, [2]int{offset, chunk.jumpTarget(offset)})
+		}
+
+		size := chunk.instructionSize(offset)
+		if offset+size > len(chunk.code) {
+			return fmt.Errorf("truncated operand for %s at offset %d", op, offset)
+		}
+		if op == OpClosure || op == OpClosureLong {
+			// Each captured variable is an is-local flag and an index.
+			for i := offset + 1 + operands; i < offset+size; i += 2 {
+				isLocal, index := chunk.code[i], int(chunk.code[i+1])
+				if isLocal > 1 {
+					return fmt.Errorf("invalid upvalue kind %d at offset %d", isLocal, i)
+				}
+				if isLocal == 0 && index >= upvalueCount {
+					return fmt.Errorf("upvalue index %d out of range at offset %d", index, i)
+				}
+			}
+		}
+		lastOp = op
+		offset += size
+	}
+
+	if lastOp != OpReturn {
+		return fmt.Errorf("chunk does not end with a return")
+	}
+	for _, jump := range jumps {
+		offset, target := jump[0], jump[1]
+		if target < 0 || target >= len(chunk.code) || !starts[target] {
+			return fmt.Errorf("jump at offset %d targets invalid offset %d", offset, target)
+		}
+	}
+	for _, constant := range chunk.constants {
+		if function, ok := constant.(*FunctionValue); ok {
+			if err := function.chunk.validate(function.upvalueCount); err != nil {
+				return fmt.Errorf("in %s: %w", function, err)
+			}
+		}
+	}
+	return nil
+}
+
+// constantLong decodes the 24-bit constant index of the _LONG instruction
+// at offset.
+func (chunk *Chunk) constantLong(offset int) int {
+	return int(chunk.code[offset+1])<<16 | int(chunk.code[offset+2])<<8 | int(chunk.code[offset+3])
+}
+
+// constantOperand decodes the constant index of the instruction at
+// offset, if its operand refers to the constant pool.
+func (chunk *Chunk) constantOperand(offset int) (int, bool) {
+	op := OpCode(chunk.code[offset])
+	if _, ok := longForms[op]; ok {
+		return int(chunk.code[offset+1]), true
+	}
+	switch op {
+	case OpConstantLong, OpDefineGlobalLong, OpGetGlobalLong, OpSetGlobalLong, OpClosureLong, OpClassLong,
+		OpGetPropertyLong, OpSetPropertyLong, OpMethodLong, OpGetSuperLong:
+		return chunk.constantLong(offset), true
+	}
+	return 0, false
+}
+
+// constantIndex decodes the constant loaded by the OP_CONSTANT or
+// OP_CONSTANT_LONG instruction at offset.
+func (chunk *Chunk) constantIndex(offset int) (int, bool) {
+	switch OpCode(chunk.code[offset]) {
+	case OpConstant:
+		return int(chunk.code[offset+1]), true
+	case OpConstantLong:
+		return chunk.constantLong(offset), true
+	}
+	return 0, false
+}
+
+// jumpTarget decodes the destination of the jump instruction at offset.
+func (chunk *Chunk) jumpTarget(offset int) int {
+	jump := int(chunk.code[offset+1])<<8 | int(chunk.code[offset+2])
+	if OpCode(chunk.code[offset]) == OpLoop {
+		return offset + 3 - jump
+	}
+	return offset + 3 + jump
+}
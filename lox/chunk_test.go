@@ -0,0 +1,182 @@
+package lox
+
+import (
+	"bytes"
+	"testing"
+)
+
+// chunkOf builds a chunk from raw bytecode, all on line 1.
+func chunkOf(code ...byte) *Chunk {
+	chunk := NewChunk()
+	for _, b := range code {
+		chunk.Write(b, 1)
+	}
+	return chunk
+}
+
+// functionOf returns a function constant with the given upvalue count whose
+// chunk is the given bytecode.
+func functionOf(name string, upvalueCount int, code ...byte) *FunctionValue {
+	function := NewFunctionValue()
+	function.name = name
+	function.upvalueCount = upvalueCount
+	function.chunk = chunkOf(code...)
+	return function
+}
+
+// mustCompile compiles source and returns the script's chunk.
+func mustCompile(t *testing.T, source string) *Chunk {
+	t.Helper()
+	function, ok := NewCompiler(source).compile()
+	if !ok {
+		t.Fatalf("%q does not compile", source)
+	}
+	return function.chunk
+}
+
+func TestValidateAcceptsCompiledCode(t *testing.T) {
+	chunk := mustCompile(t, `
+		var total = 0;
+		for (var i = 0; i < 3; i = i + 1) {
+			if (i == 1) total = total + 10; else total = total - 1;
+		}
+		while (total > 0) total = total - 3;
+		print total;
+	`)
+	if err := chunk.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+
+	closures := mustCompile(t, `
+		fun counter() {
+			var count = 0;
+			fun increment() { count = count + 1; return count; }
+			return increment;
+		}
+		var c = counter();
+		while (c() < 3) print "tick";
+	`)
+	if err := closures.Validate(); err != nil {
+		t.Errorf("Validate() = %v for closures, want nil", err)
+	}
+}
+
+func TestValidateRejectsMalformedChunks(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk *Chunk
+		want  string
+	}{
+		{"empty", chunkOf(), "empty chunk"},
+		{"unknown opcode", chunkOf(200, byte(OpReturn)), "unknown opcode 200 at offset 0"},
+		{"truncated operand", chunkOf(byte(OpNil), byte(OpJump), 0), "truncated operand for OP_JUMP at offset 1"},
+		{"constant out of range", chunkOf(byte(OpConstant), 0, byte(OpReturn)), "constant index 0 out of range at offset 0"},
+		{"no return", chunkOf(byte(OpNil), byte(OpPop)), "chunk does not end with a return"},
+		{"jump past the end", chunkOf(byte(OpJump), 0, 9, byte(OpNil), byte(OpReturn)), "jump at offset 0 targets invalid offset 12"},
+		{"jump into an operand", chunkOf(byte(OpJump), 0, 1, byte(OpGetLocal), 0, byte(OpReturn)), "jump at offset 0 targets invalid offset 4"},
+		{"loop before the start", chunkOf(byte(OpLoop), 0, 4, byte(OpReturn)), "jump at offset 0 targets invalid offset -1"},
+		{"upvalue in script", chunkOf(byte(OpGetUpvalue), 0, byte(OpReturn)), "upvalue index 0 out of range at offset 0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.chunk.Validate()
+			if err == nil || err.Error() != test.want {
+				t.Errorf("Validate() = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateChecksConstantTypes(t *testing.T) {
+	chunk := chunkOf(byte(OpGetGlobal), 0, byte(OpReturn))
+	chunk.AddConstant(NumberValue(1))
+	if err := chunk.Validate(); err == nil || err.Error() != "global name at offset 0 is not a string" {
+		t.Errorf("Validate() = %v for a numeric global name", err)
+	}
+
+	closure := chunkOf(byte(OpClosure), 0, byte(OpReturn))
+	closure.AddConstant(StringValue("f"))
+	if err := closure.Validate(); err == nil || err.Error() != "closure at offset 0 does not refer to a function" {
+		t.Errorf("Validate() = %v for a closure over a string", err)
+	}
+}
+
+func TestValidateChecksClosureUpvalues(t *testing.T) {
+	tests := []struct {
+		name     string
+		upvalues []byte
+		want     string
+	}{
+		{"local", []byte{1, 0}, ""},
+		{"invalid kind", []byte{2, 0}, "invalid upvalue kind 2 at offset 3"},
+		// The script has no upvalues of its own to pass on.
+		{"enclosing upvalue", []byte{0, 0}, "upvalue index 0 out of range at offset 3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code := append([]byte{byte(OpNil), byte(OpClosure), 0}, test.upvalues...)
+			chunk := chunkOf(append(code, byte(OpReturn))...)
+			chunk.AddConstant(functionOf("f", 1, byte(OpGetUpvalue), 0, byte(OpReturn)))
+			err := chunk.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+			} else if err == nil || err.Error() != test.want {
+				t.Errorf("Validate() = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateChecksNestedFunctions(t *testing.T) {
+	chunk := chunkOf(byte(OpNil), byte(OpClosure), 0, 1, 0, byte(OpReturn))
+	// f reads a second upvalue but only captures one.
+	chunk.AddConstant(functionOf("f", 1, byte(OpGetUpvalue), 1, byte(OpReturn)))
+	want := "in <fn f>: upvalue index 1 out of range at offset 0"
+	if err := chunk.Validate(); err == nil || err.Error() != want {
+		t.Errorf("Validate() = %v, want %q", err, want)
+	}
+}
+
+func TestLoadChunkValidates(t *testing.T) {
+	chunk := chunkOf(byte(OpConstant), 3, byte(OpReturn))
+	var buffer bytes.Buffer
+	if err := chunk.Serialize(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	want := "constant index 3 out of range at offset 0"
+	if _, err := LoadChunk(&buffer); err == nil || err.Error() != want {
+		t.Errorf("LoadChunk() = %v, want %q", err, want)
+	}
+}
+
+func TestValidateChecksTheLineTable(t *testing.T) {
+	chunk := chunkOf(byte(OpNil), byte(OpReturn))
+	chunk.lines = chunk.lines[:1]
+	if err := chunk.Validate(); err == nil || err.Error() != "line table has 1 entries for 2 bytes of code" {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+// opcodes returns the opcodes of chunk's instructions in order.
+func opcodes(chunk *Chunk) []OpCode {
+	var ops []OpCode
+	for offset := 0; offset < len(chunk.code); {
+		op := OpCode(chunk.code[offset])
+		ops = append(ops, op)
+		offset += 1 + operandCount(op)
+	}
+	return ops
+}
+
+// countOp returns how many times op appears in chunk.
+func countOp(chunk *Chunk, op OpCode) int {
+	count := 0
+	for _, each := range opcodes(chunk) {
+		if each == op {
+			count++
+		}
+	}
+	return count
+}
@@ -2,48 +2,187 @@ package lox
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parser holds the token stream and error state shared by a compiler and
+// the compilers it creates for nested functions.
+type Parser struct {
+	scanner   *Scanner
+	source    string
+	previous  Token
+	current   Token
+	hadError  bool
+	panicMode bool
+	// currentClass is the innermost class being compiled, or nil outside
+	// of a class body.
+	currentClass *ClassCompiler
+	// errOut receives each error as it is reported; errors keeps them.
+	errOut io.Writer
+	errors []string
+	// assignmentCheck selects how an assignment used as an if or while
+	// condition is reported.
+	assignmentCheck AssignmentCheck
+	// maxErrors is how many errors are reported before compilation stops,
+	// or 0 for no limit. Once it is reached, stopped is set and the
+	// scanner is treated as exhausted.
+	maxErrors int
+	stopped   bool
+}
+
+// DefaultMaxErrors is how many compile errors are reported before the
+// compiler gives up on a script.
+const DefaultMaxErrors = 20
+
+// AssignmentCheck selects how the compiler treats an assignment used
+// directly as an if or while condition, as in "if (x = 5)". Wrapping the
+// assignment in an extra pair of parentheses marks it as intended.
+type AssignmentCheck int
+
+const (
+	AssignmentCheckOff AssignmentCheck = iota
+	// AssignmentCheckWarn prints a warning and compiles the code anyway.
+	AssignmentCheckWarn
+	// AssignmentCheckError makes it a compile error.
+	AssignmentCheckError
 )
 
 type Compiler struct {
-	chunk      *Chunk
-	scanner    *Scanner
-	source     string
-	previous   Token
-	current    Token
-	hadError   bool
-	panicMode  bool
-	locals     []Local
-	scopeDepth int
+	*Parser
+	enclosing    *Compiler
+	function     *FunctionValue
+	functionType FunctionType
+	locals       []Local
+	upvalues     []Upvalue
+	scopeDepth   int
+	// stringExpr is set when the expression just compiled is known to
+	// produce a string, which lets '+' compile to OP_CONCAT. Rules that
+	// may produce anything else clear it.
+	stringExpr bool
+	// groupStart and groupEnd span the code of the most recently
+	// finished parenthesized expression.
+	groupStart int
+	groupEnd   int
+	// operandStart is where the left operand of the infix rule being
+	// compiled begins.
+	operandStart int
+	// identifiers maps each name already in the constant pool to its
+	// index, so every reference to a name shares one constant.
+	identifiers map[StringValue]int
+	// assignment is the '=' of the most recently compiled assignment.
+	assignment Token
 }
 
+type FunctionType int
+
+const (
+	FunctionTypeFunction FunctionType = iota
+	FunctionTypeInitializer
+	FunctionTypeMethod
+	FunctionTypeScript
+	// FunctionTypeEval is code run by eval. It is compiled like a script,
+	// but a top-level return hands a value back to eval's caller.
+	FunctionTypeEval
+)
+
+// ClassCompiler tracks the class declarations enclosing the code being
+// compiled, so 'this' can be rejected outside of methods.
+type ClassCompiler struct {
+	enclosing     *ClassCompiler
+	hasSuperclass bool
+}
+
+const maxLocals = 1 << 16
+
+// maxConstants is the number of constants the 24-bit operand of the
+// _LONG instructions can address.
+const maxConstants = 1 << 24
+
 type Local struct {
-	name  Token
-	depth int
+	name       Token
+	depth      int
+	isCaptured bool
 }
 
-func NewCompiler(source string, chunk *Chunk) *Compiler {
-	return &Compiler{
-		chunk:      chunk,
-		scanner:    NewScanner(source),
-		source:     source,
-		previous:   Token{},
-		current:    Token{},
-		hadError:   false,
-		panicMode:  false,
-		locals:     make([]Local, 0),
-		scopeDepth: 0,
+// Upvalue records where a closure finds a captured variable: a local slot
+// of the immediately enclosing function, or one of its upvalues.
+type Upvalue struct {
+	index   int
+	isLocal bool
+}
+
+// CompileError lists every error found while compiling a script. The
+// compiler recovers at statement boundaries, so independent mistakes are
+// all reported in one pass.
+type CompileError struct {
+	Errors []string
+}
+
+func (err *CompileError) Error() string {
+	return strings.Join(err.Errors, "\n")
+}
+
+// Compile compiles source without running it and returns the chunk of
+// the top-level script. Compile errors are reported to stderr as they are
+// found and returned together as a *CompileError.
+func Compile(source string) (*Chunk, error) {
+	compiler := NewCompiler(source)
+	function, ok := compiler.compile()
+	if !ok {
+		return nil, &CompileError{Errors: compiler.errors}
+	}
+	return function.chunk, nil
+}
+
+func NewCompiler(source string) *Compiler {
+	parser := &Parser{
+		scanner:   NewScanner(source),
+		source:    source,
+		previous:  Token{},
+		current:   Token{},
+		hadError:  false,
+		panicMode: false,
+		errOut:    os.Stderr,
+		maxErrors: DefaultMaxErrors,
+	}
+	return newCompiler(parser, nil, FunctionTypeScript)
+}
+
+func newCompiler(parser *Parser, enclosing *Compiler, functionType FunctionType) *Compiler {
+	compiler := &Compiler{
+		Parser:       parser,
+		enclosing:    enclosing,
+		function:     NewFunctionValue(),
+		functionType: functionType,
+		locals:       make([]Local, 0),
+		upvalues:     make([]Upvalue, 0),
+		scopeDepth:   0,
+		identifiers:  make(map[StringValue]int),
+	}
+	if functionType != FunctionTypeScript {
+		compiler.function.name = parser.previous.lexeme
+	}
+	// Slot zero holds the function being called, or the receiver in a
+	// method, where it is reachable as 'this'.
+	slotZero := Token{}
+	if functionType == FunctionTypeMethod || functionType == FunctionTypeInitializer {
+		slotZero = Token{tokenType: TokenThis, lexeme: "this"}
 	}
+	compiler.locals = append(compiler.locals, Local{name: slotZero, depth: 0})
+	return compiler
 }
 
-func (compiler *Compiler) compile() bool {
+func (compiler *Compiler) compile() (*FunctionValue, bool) {
 	compiler.advance()
 	for !compiler.match(TokenEOF) {
 		compiler.declaration()
 	}
-	compiler.end()
-	return !compiler.hadError
+	function := compiler.end()
+	return function, !compiler.hadError
 }
 
 func (compiler *Compiler) emitByte(byte byte) {
@@ -51,19 +190,30 @@ func (compiler *Compiler) emitByte(byte byte) {
 }
 
 func (compiler *Compiler) currentChunk() *Chunk {
-	return compiler.chunk
+	return compiler.function.chunk
 }
 
-func (compiler *Compiler) end() {
+func (compiler *Compiler) end() *FunctionValue {
 	compiler.emitReturn()
 
 	//debug
 	// if !compiler.hadError {
-	// 	compiler.currentChunk().Disassemble("code")
+	// 	name := compiler.function.name
+	// 	if name == "" {
+	// 		name = "<script>"
+	// 	}
+	// 	compiler.currentChunk().Disassemble(name)
 	// }
+	return compiler.function
 }
 
 func (compiler *Compiler) emitReturn() {
+	if compiler.functionType == FunctionTypeInitializer {
+		// An initializer always returns the instance.
+		compiler.emitBytes(byte(OpGetLocal), 0)
+	} else {
+		compiler.emitByte(byte(OpNil))
+	}
 	compiler.emitByte(byte(OpReturn))
 }
 
@@ -73,18 +223,40 @@ func (compiler *Compiler) emitBytes(byte1, byte2 byte) {
 }
 
 func (compiler *Compiler) emitConstant(value Value) {
-	compiler.emitBytes(byte(OpConstant), byte(compiler.makeConstant(value)))
+	compiler.emitConstantOperand(OpConstant, compiler.makeConstant(value))
+}
+
+// emitConstantOperand emits an instruction that refers to a constant,
+// switching to its _LONG form when the index doesn't fit in one byte.
+func (compiler *Compiler) emitConstantOperand(op OpCode, constant int) {
+	if constant <= math.MaxUint8 {
+		compiler.emitBytes(byte(op), byte(constant))
+		return
+	}
+	compiler.emitByte(byte(longForms[op]))
+	compiler.emitBytes(byte(constant>>16), byte(constant>>8))
+	compiler.emitByte(byte(constant))
 }
 
 func (compiler *Compiler) makeConstant(value Value) int {
-	return compiler.currentChunk().AddConstant(value)
+	constant := compiler.currentChunk().AddConstant(value)
+	if constant >= maxConstants {
+		compiler.error("Too many constants in one chunk.")
+		return 0
+	}
+	return constant
 }
 
 func (compiler *Compiler) advance() {
 	compiler.previous = compiler.current
+	if compiler.stopped {
+		previous := compiler.previous
+		compiler.current = Token{tokenType: TokenEOF, line: previous.line, column: previous.column, start: previous.end, end: previous.end}
+		return
+	}
 
 	for {
-		compiler.current = compiler.scanner.scanToken()
+		compiler.current = compiler.scanner.ScanToken()
 		if compiler.current.tokenType != TokenError {
 			break
 		}
@@ -101,22 +273,65 @@ func (compiler *Compiler) error(message string) {
 }
 
 func (compiler *Compiler) errorAt(token *Token, message string) {
-	if compiler.panicMode {
+	if compiler.panicMode || compiler.stopped {
 		return
 	}
 	compiler.panicMode = true
-	fmt.Fprintf(os.Stderr, "[line %d] Error", token.line)
+	text := fmt.Sprintf("[line %d, col %d] Error", token.line, token.column)
 
 	if token.tokenType == TokenEOF {
-		fmt.Fprintf(os.Stderr, " at end")
+		text += " at end"
 	} else if token.tokenType == TokenError {
 		// Nothing.
 	} else {
-		fmt.Fprintf(os.Stderr, " at '%s'", token.lexeme)
+		text += fmt.Sprintf(" at '%s'", token.lexeme)
 	}
 
-	fmt.Fprintf(os.Stderr, ": %s\n", message)
+	text += ": " + message
+	fmt.Fprintln(compiler.errOut, text)
+	compiler.writeSourceLine(token)
+	compiler.errors = append(compiler.errors, text)
 	compiler.hadError = true
+
+	if compiler.maxErrors > 0 && len(compiler.errors) == compiler.maxErrors {
+		summary := fmt.Sprintf("Too many errors; stopping after %d.", compiler.maxErrors)
+		fmt.Fprintln(compiler.errOut, summary)
+		compiler.errors = append(compiler.errors, summary)
+		compiler.stopped = true
+	}
+}
+
+// writeSourceLine shows the line a token starts on with carets under the
+// token. Tabs before the token are kept so the carets line up however the
+// tabs are rendered.
+func (compiler *Compiler) writeSourceLine(token *Token) {
+	lines := strings.Split(compiler.source, "\n")
+	if token.line < 1 || token.line > len(lines) {
+		return
+	}
+	line := []rune(strings.TrimSuffix(lines[token.line-1], "\r"))
+	column := token.column - 1
+	if column > len(line) {
+		return
+	}
+
+	var indent strings.Builder
+	for _, c := range line[:column] {
+		if c == '\t' {
+			indent.WriteRune('\t')
+		} else {
+			indent.WriteRune(' ')
+		}
+	}
+	width := 1
+	if token.tokenType != TokenError && token.tokenType != TokenEOF {
+		// Only underline the part of a multi-line token on this line.
+		lexeme := strings.SplitN(token.lexeme, "\n", 2)[0]
+		if n := utf8.RuneCountInString(lexeme); n > 1 {
+			width = n
+		}
+	}
+	fmt.Fprintf(compiler.errOut, "    %s\n    %s%s\n", string(line), indent.String(), strings.Repeat("^", width))
 }
 
 func (compiler *Compiler) consume(tokenType TokenType, message string) {
@@ -139,7 +354,11 @@ func (compiler *Compiler) check(tokenType TokenType) bool {
 }
 
 func (compiler *Compiler) declaration() {
-	if compiler.match(TokenVar) {
+	if compiler.match(TokenClass) {
+		compiler.classDeclaration()
+	} else if compiler.match(TokenFun) {
+		compiler.funDeclaration()
+	} else if compiler.match(TokenVar) {
 		compiler.varDeclaration()
 	} else {
 		compiler.statement()
@@ -165,6 +384,104 @@ func (compiler *Compiler) synchronize() {
 	}
 }
 
+func (compiler *Compiler) classDeclaration() {
+	compiler.consume(TokenIdentifier, "Expect class name.")
+	nameConstant := compiler.identifierConstant(&compiler.previous)
+	compiler.declareVariable()
+
+	className := compiler.previous
+	compiler.emitConstantOperand(OpClass, nameConstant)
+	compiler.defineVariable(nameConstant)
+
+	compiler.currentClass = &ClassCompiler{enclosing: compiler.currentClass}
+
+	if compiler.match(TokenLess) {
+		compiler.consume(TokenIdentifier, "Expect superclass name.")
+		compiler.variable(false)
+		if compiler.previous.lexeme == className.lexeme {
+			compiler.error("A class can't inherit from itself.")
+		}
+
+		// Each subclass gets its own scope holding 'super', so methods
+		// capture the right superclass even when classes are declared in
+		// the same scope.
+		compiler.beginScope()
+		compiler.addLocal(Token{tokenType: TokenSuper, lexeme: "super"})
+		compiler.defineVariable(0)
+
+		compiler.namedVariable(className, false)
+		compiler.emitByte(byte(OpInherit))
+		compiler.currentClass.hasSuperclass = true
+	}
+
+	// Keep the class on the stack while its methods are attached.
+	compiler.namedVariable(className, false)
+	compiler.consume(TokenLeftBrace, "Expect '{' before class body.")
+	for !compiler.check(TokenRightBrace) && !compiler.check(TokenEOF) {
+		compiler.method()
+	}
+	compiler.consume(TokenRightBrace, "Expect '}' after class body.")
+	compiler.emitByte(byte(OpPop))
+
+	if compiler.currentClass.hasSuperclass {
+		compiler.endScope()
+	}
+	compiler.currentClass = compiler.currentClass.enclosing
+}
+
+func (compiler *Compiler) method() {
+	compiler.consume(TokenIdentifier, "Expect method name.")
+	constant := compiler.identifierConstant(&compiler.previous)
+
+	functionType := FunctionTypeMethod
+	if compiler.previous.lexeme == "init" {
+		functionType = FunctionTypeInitializer
+	}
+	compiler.compileFunction(functionType)
+	compiler.emitConstantOperand(OpMethod, constant)
+}
+
+func (compiler *Compiler) funDeclaration() {
+	global := compiler.parseVariable("Expect function name.")
+	// A function may refer to itself, so its name is usable in its body.
+	compiler.markInitialized()
+	compiler.compileFunction(FunctionTypeFunction)
+	compiler.defineVariable(global)
+}
+
+func (compiler *Compiler) compileFunction(functionType FunctionType) {
+	inner := newCompiler(compiler.Parser, compiler, functionType)
+	inner.beginScope()
+
+	inner.consume(TokenLeftParen, "Expect '(' after function name.")
+	if !inner.check(TokenRightParen) {
+		for {
+			inner.function.arity++
+			if inner.function.arity > 255 {
+				inner.errorAtCurrent("Can't have more than 255 parameters.")
+			}
+			constant := inner.parseVariable("Expect parameter name.")
+			inner.defineVariable(constant)
+			if !inner.match(TokenComma) {
+				break
+			}
+		}
+	}
+	inner.consume(TokenRightParen, "Expect ')' after parameters.")
+	inner.consume(TokenLeftBrace, "Expect '{' before function body.")
+	inner.block()
+
+	function := inner.end()
+	compiler.emitConstantOperand(OpClosure, compiler.makeConstant(function))
+	for _, upvalue := range inner.upvalues {
+		isLocal := byte(0)
+		if upvalue.isLocal {
+			isLocal = 1
+		}
+		compiler.emitBytes(isLocal, byte(upvalue.index))
+	}
+}
+
 func (compiler *Compiler) varDeclaration() {
 	global := compiler.parseVariable("Expect variable name.")
 	if compiler.match(TokenEqual) {
@@ -204,11 +521,21 @@ func (compiler *Compiler) declareVariable() {
 }
 
 func (compiler *Compiler) addLocal(name Token) {
-	compiler.locals = append(compiler.locals, Local{name, -1})
+	if len(compiler.locals) == maxLocals {
+		compiler.error("Too many local variables in function.")
+		return
+	}
+	compiler.locals = append(compiler.locals, Local{name: name, depth: -1})
 }
 
 func (compiler *Compiler) identifierConstant(token *Token) int {
-	return compiler.makeConstant(StringValue(token.lexeme))
+	name := StringValue(token.lexeme)
+	if constant, ok := compiler.identifiers[name]; ok {
+		return constant
+	}
+	constant := compiler.makeConstant(name)
+	compiler.identifiers[name] = constant
+	return constant
 }
 
 func (compiler *Compiler) defineVariable(global int) {
@@ -216,10 +543,13 @@ func (compiler *Compiler) defineVariable(global int) {
 		compiler.markInitialized()
 		return
 	}
-	compiler.emitBytes(byte(OpDefineGlobal), byte(global))
+	compiler.emitConstantOperand(OpDefineGlobal, global)
 }
 
 func (compiler *Compiler) markInitialized() {
+	if compiler.scopeDepth == 0 {
+		return
+	}
 	compiler.locals[len(compiler.locals)-1].depth = compiler.scopeDepth
 }
 
@@ -228,6 +558,8 @@ func (compiler *Compiler) statement() {
 		compiler.printStatement()
 	} else if compiler.match(TokenIf) {
 		compiler.ifStatement()
+	} else if compiler.match(TokenReturn) {
+		compiler.returnStatement()
 	} else if compiler.match(TokenWhile) {
 		compiler.whileStatement()
 	} else if compiler.match(TokenFor) {
@@ -241,6 +573,22 @@ func (compiler *Compiler) statement() {
 	}
 }
 
+func (compiler *Compiler) returnStatement() {
+	if compiler.functionType == FunctionTypeScript {
+		compiler.error("Can't return from top-level code.")
+	}
+	if compiler.match(TokenSemicolon) {
+		compiler.emitReturn()
+		return
+	}
+	if compiler.functionType == FunctionTypeInitializer {
+		compiler.error("Can't return a value from an initializer.")
+	}
+	compiler.expression()
+	compiler.consume(TokenSemicolon, "Expect ';' after return value.")
+	compiler.emitByte(byte(OpReturn))
+}
+
 func (compiler *Compiler) beginScope() {
 	compiler.scopeDepth++
 }
@@ -248,7 +596,11 @@ func (compiler *Compiler) beginScope() {
 func (compiler *Compiler) endScope() {
 	compiler.scopeDepth--
 	for len(compiler.locals) > 0 && compiler.locals[len(compiler.locals)-1].depth > compiler.scopeDepth {
-		compiler.emitByte(byte(OpPop))
+		if compiler.locals[len(compiler.locals)-1].isCaptured {
+			compiler.emitByte(byte(OpCloseUpvalue))
+		} else {
+			compiler.emitByte(byte(OpPop))
+		}
 		compiler.locals = compiler.locals[:len(compiler.locals)-1]
 	}
 }
@@ -296,8 +648,7 @@ func (compiler *Compiler) forStatement() {
 func (compiler *Compiler) whileStatement() {
 	loopStart := len(compiler.currentChunk().code)
 	compiler.consume(TokenLeftParen, "Expect '(' after 'while'.")
-	compiler.expression()
-	compiler.consume(TokenRightParen, "Expect ')' after condition.")
+	compiler.condition()
 	exitJump := compiler.emitJump(OpJumpIfFalse)
 	compiler.emitByte(byte(OpPop))
 	compiler.statement()
@@ -309,14 +660,16 @@ func (compiler *Compiler) whileStatement() {
 func (compiler *Compiler) emitLoop(loopStart int) {
 	compiler.emitByte(byte(OpLoop))
 	offset := len(compiler.currentChunk().code) - loopStart + 2
+	if offset > 0xffff {
+		compiler.error("Loop body too large.")
+	}
 	compiler.emitByte(byte((offset >> 8) & 0xff))
 	compiler.emitByte(byte(offset & 0xff))
 }
 
 func (compiler *Compiler) ifStatement() {
 	compiler.consume(TokenLeftParen, "Expect '(' after 'if'.")
-	compiler.expression()
-	compiler.consume(TokenRightParen, "Expect ')' after condition.")
+	compiler.condition()
 
 	thenJump := compiler.emitJump(OpJumpIfFalse)
 	compiler.emitByte(byte(OpPop))
@@ -331,6 +684,37 @@ func (compiler *Compiler) ifStatement() {
 	compiler.patchJump(elseJump)
 }
 
+// condition compiles the parenthesized condition of an if or while
+// statement, checking for an accidental assignment.
+func (compiler *Compiler) condition() {
+	start := len(compiler.currentChunk().code)
+	compiler.expression()
+	compiler.consume(TokenRightParen, "Expect ')' after condition.")
+
+	if compiler.assignmentCheck == AssignmentCheckOff {
+		return
+	}
+	end := len(compiler.currentChunk().code)
+	if compiler.groupStart == start && compiler.groupEnd == end {
+		return
+	}
+	last := compiler.lastInstruction(start)
+	if last == -1 {
+		return
+	}
+	switch OpCode(compiler.currentChunk().code[last]) {
+	case OpSetLocal, OpSetLocalLong, OpSetGlobal, OpSetGlobalLong, OpSetUpvalue, OpSetProperty, OpSetPropertyLong:
+		message := "Assignment used as a condition; use '==' to compare or wrap it in parentheses."
+		token := compiler.assignment
+		if compiler.assignmentCheck == AssignmentCheckError {
+			compiler.errorAt(&token, message)
+		} else {
+			fmt.Fprintf(compiler.errOut, "[line %d, col %d] Warning: %s\n", token.line, token.column, message)
+			compiler.writeSourceLine(&token)
+		}
+	}
+}
+
 func (compiler *Compiler) emitJump(instruction OpCode) int {
 	compiler.emitByte(byte(instruction))
 	compiler.emitByte(0xff)
@@ -340,6 +724,9 @@ func (compiler *Compiler) emitJump(instruction OpCode) int {
 
 func (compiler *Compiler) patchJump(offset int) {
 	jump := len(compiler.currentChunk().code) - offset - 2
+	if jump > 0xffff {
+		compiler.error("Too much code to jump over.")
+	}
 	compiler.currentChunk().code[offset] = byte((jump >> 8) & 0xff)
 	compiler.currentChunk().code[offset+1] = byte(jump & 0xff)
 }
@@ -368,25 +755,80 @@ func (compiler *Compiler) expression() {
 }
 
 func (compiler *Compiler) number(_ bool) {
-	value, _ := strconv.ParseFloat(compiler.previous.lexeme, 64)
-	compiler.emitConstant(NumberValue(value))
+	compiler.emitNumber(parseNumber(compiler.previous.lexeme))
+}
+
+// emitNumber pushes small integers inline with OP_IMMEDIATE instead of
+// spending a constant-pool slot on them.
+func (compiler *Compiler) emitNumber(value Value) {
+	if n, ok := value.(IntValue); ok && n >= math.MinInt8 && n <= math.MaxInt8 {
+		compiler.emitBytes(byte(OpImmediate), byte(int8(n)))
+		return
+	}
+	compiler.emitConstant(value)
 }
 
 func (compiler *Compiler) grouping(_ bool) {
+	start := len(compiler.currentChunk().code)
 	compiler.expression()
 	compiler.consume(TokenRightParen, "Expect ')' after expression.")
+	compiler.groupStart, compiler.groupEnd = start, len(compiler.currentChunk().code)
 }
 
 func (compiler *Compiler) unary(_ bool) {
 	operatorType := compiler.previous.tokenType
+	operandStart := len(compiler.currentChunk().code)
 	compiler.parsePrecedence(PrecedenceUnary)
 
+	compiler.stringExpr = false
+
 	switch operatorType {
 	case TokenMinus:
 		compiler.emitByte(byte(OpNegate))
 	case TokenBang:
-		compiler.emitByte(byte(OpNot))
+		if !compiler.fuseNot(operandStart) {
+			compiler.emitByte(byte(OpNot))
+		}
+	}
+}
+
+// fuseNot folds a '!' into an operand that ends in an equality test by
+// flipping the test. Ordered comparisons are left alone: with NaN,
+// !(a < b) is not the same as a >= b.
+func (compiler *Compiler) fuseNot(operandStart int) bool {
+	last := compiler.lastInstruction(operandStart)
+	if last == -1 {
+		return false
+	}
+	code := compiler.currentChunk().code
+	switch OpCode(code[last]) {
+	case OpEqual:
+		code[last] = byte(OpNotEqual)
+	case OpNotEqual:
+		code[last] = byte(OpEqual)
+	default:
+		return false
 	}
+	return true
+}
+
+// lastInstruction returns the offset of the final instruction emitted
+// since start, or -1 if nothing was emitted or the code contains a jump,
+// in which case the final instruction doesn't necessarily produce the
+// value left on the stack.
+func (compiler *Compiler) lastInstruction(start int) int {
+	code := compiler.currentChunk().code
+	last := -1
+	for offset := start; offset < len(code); {
+		op := OpCode(code[offset])
+		switch op {
+		case OpJump, OpJumpIfFalse, OpLoop:
+			return -1
+		}
+		last = offset
+		offset += compiler.currentChunk().instructionSize(offset)
+	}
+	return last
 }
 
 func (compiler *Compiler) parsePrecedence(precedence Precedence) {
@@ -397,12 +839,15 @@ func (compiler *Compiler) parsePrecedence(precedence Precedence) {
 		return
 	}
 	canAssign := precedence <= PrecedenceAssignment
-	prefixRule(canAssign)
+	start := len(compiler.currentChunk().code)
+	compiler.stringExpr = false
+	prefixRule(compiler, canAssign)
 
 	for precedence <= compiler.getRule(compiler.current.tokenType).precedence {
 		compiler.advance()
 		infixRule := compiler.getRule(compiler.previous.tokenType).infix
-		infixRule(canAssign)
+		compiler.operandStart = start
+		infixRule(compiler, canAssign)
 	}
 
 	if canAssign && compiler.match(TokenEqual) {
@@ -412,18 +857,41 @@ func (compiler *Compiler) parsePrecedence(precedence Precedence) {
 
 func (compiler *Compiler) binary(_ bool) {
 	operatorType := compiler.previous.tokenType
+	leftIsString := compiler.stringExpr
+	leftStart := compiler.operandStart
+	rightStart := len(compiler.currentChunk().code)
 	rule := compiler.getRule(operatorType)
-	compiler.parsePrecedence(rule.precedence + 1)
+	if operatorType == TokenStarStar {
+		// Right-associative: 2 ** 3 ** 2 is 2 ** (3 ** 2).
+		compiler.parsePrecedence(rule.precedence)
+	} else {
+		compiler.parsePrecedence(rule.precedence + 1)
+	}
+	rightIsString := compiler.stringExpr
+	compiler.stringExpr = false
+
+	if compiler.foldNumbers(operatorType, leftStart, rightStart) {
+		return
+	}
 
 	switch operatorType {
 	case TokenPlus:
-		compiler.emitByte(byte(OpAdd))
+		if leftIsString && rightIsString {
+			compiler.emitByte(byte(OpConcat))
+			compiler.stringExpr = true
+		} else {
+			compiler.emitByte(byte(OpAdd))
+		}
 	case TokenMinus:
 		compiler.emitByte(byte(OpSubtract))
 	case TokenStar:
 		compiler.emitByte(byte(OpMultiply))
 	case TokenSlash:
 		compiler.emitByte(byte(OpDivide))
+	case TokenPercent:
+		compiler.emitByte(byte(OpModulo))
+	case TokenStarStar:
+		compiler.emitByte(byte(OpExponent))
 	case TokenBangEqual:
 		compiler.emitByte(byte(OpNotEqual))
 	case TokenEqualEqual:
@@ -439,6 +907,104 @@ func (compiler *Compiler) binary(_ bool) {
 	}
 }
 
+// foldNumbers replaces arithmetic on two number literals with its result.
+// Each operand must be a single instruction pushing a number. Division by
+// zero is left for the VM to handle at runtime.
+func (compiler *Compiler) foldNumbers(operatorType TokenType, leftStart, rightStart int) bool {
+	a, ok := compiler.numberAt(leftStart, rightStart)
+	if !ok {
+		return false
+	}
+	b, ok := compiler.numberAt(rightStart, len(compiler.currentChunk().code))
+	if !ok {
+		return false
+	}
+
+	var op OpCode
+	switch operatorType {
+	case TokenPlus:
+		op = OpAdd
+	case TokenMinus:
+		op = OpSubtract
+	case TokenStar:
+		op = OpMultiply
+	case TokenSlash:
+		if toFloat(b) == 0 {
+			return false
+		}
+		op = OpDivide
+	default:
+		return false
+	}
+	result := arithmetic(op, a, b)
+
+	chunk := compiler.currentChunk()
+	// Drop the operands' constants if nothing was added after them.
+	for _, offset := range []int{rightStart, leftStart} {
+		if index, ok := chunk.constantIndex(offset); ok && index == len(chunk.constants)-1 {
+			chunk.constants = chunk.constants[:index]
+		}
+	}
+	chunk.code = chunk.code[:leftStart]
+	chunk.lines = chunk.lines[:leftStart]
+	compiler.emitNumber(result)
+	return true
+}
+
+// numberAt returns the number pushed by the code between start and end,
+// if it is exactly one OP_IMMEDIATE or constant instruction.
+func (compiler *Compiler) numberAt(start, end int) (Value, bool) {
+	chunk := compiler.currentChunk()
+	if start >= end || start+chunk.instructionSize(start) != end {
+		return nil, false
+	}
+	if OpCode(chunk.code[start]) == OpImmediate {
+		return IntValue(int8(chunk.code[start+1])), true
+	}
+	index, ok := chunk.constantIndex(start)
+	if !ok || !isNumber(chunk.constants[index].Type()) {
+		return nil, false
+	}
+	return chunk.constants[index], true
+}
+
+func (compiler *Compiler) call(_ bool) {
+	argCount := compiler.argumentList()
+	compiler.emitBytes(byte(OpCall), byte(argCount))
+	compiler.stringExpr = false
+}
+
+func (compiler *Compiler) dot(canAssign bool) {
+	compiler.consume(TokenIdentifier, "Expect property name after '.'.")
+	name := compiler.identifierConstant(&compiler.previous)
+
+	if compiler.matchAssignment(canAssign) {
+		compiler.expression()
+		compiler.emitConstantOperand(OpSetProperty, name)
+	} else {
+		compiler.emitConstantOperand(OpGetProperty, name)
+		compiler.stringExpr = false
+	}
+}
+
+func (compiler *Compiler) argumentList() int {
+	argCount := 0
+	if !compiler.check(TokenRightParen) {
+		for {
+			compiler.expression()
+			if argCount == 255 {
+				compiler.error("Can't have more than 255 arguments.")
+			}
+			argCount++
+			if !compiler.match(TokenComma) {
+				break
+			}
+		}
+	}
+	compiler.consume(TokenRightParen, "Expect ')' after arguments.")
+	return argCount
+}
+
 func (compiler *Compiler) literal(_ bool) {
 	switch compiler.previous.tokenType {
 	case TokenFalse:
@@ -453,25 +1019,56 @@ func (compiler *Compiler) literal(_ bool) {
 func (compiler *Compiler) string(_ bool) {
 	lexeme := compiler.previous.lexeme
 	compiler.emitConstant(StringValue(lexeme[1 : len(lexeme)-1]))
+	compiler.stringExpr = true
 }
 
 func (compiler *Compiler) variable(canAssign bool) {
 	compiler.namedVariable(compiler.previous, canAssign)
 }
 
+func (compiler *Compiler) this(_ bool) {
+	if compiler.currentClass == nil {
+		compiler.error("Can't use 'this' outside of a class.")
+		return
+	}
+	// 'this' is read-only, so it is never an assignment target.
+	compiler.variable(false)
+}
+
+func (compiler *Compiler) super(_ bool) {
+	if compiler.currentClass == nil {
+		compiler.error("Can't use 'super' outside of a class.")
+	} else if !compiler.currentClass.hasSuperclass {
+		compiler.error("Can't use 'super' in a class with no superclass.")
+	}
+	compiler.consume(TokenDot, "Expect '.' after 'super'.")
+	compiler.consume(TokenIdentifier, "Expect superclass method name.")
+	name := compiler.identifierConstant(&compiler.previous)
+
+	compiler.namedVariable(Token{tokenType: TokenThis, lexeme: "this"}, false)
+	compiler.namedVariable(Token{tokenType: TokenSuper, lexeme: "super"}, false)
+	compiler.emitConstantOperand(OpGetSuper, name)
+}
+
 func (compiler *Compiler) namedVariable(token Token, canAssign bool) {
 	var getOp, setOp byte
 	arg := compiler.resolveLocal(token)
+	if arg > 0xff {
+		compiler.wideLocal(arg, canAssign)
+		return
+	}
 	if arg != -1 {
 		getOp = byte(OpGetLocal)
 		setOp = byte(OpSetLocal)
+	} else if arg = compiler.resolveUpvalue(token); arg != -1 {
+		getOp = byte(OpGetUpvalue)
+		setOp = byte(OpSetUpvalue)
 	} else {
-		arg = compiler.identifierConstant(&token)
-		getOp = byte(OpGetGlobal)
-		setOp = byte(OpSetGlobal)
+		compiler.globalVariable(token, canAssign)
+		return
 	}
 
-	if canAssign && compiler.match(TokenEqual) {
+	if compiler.matchAssignment(canAssign) {
 		compiler.expression()
 		compiler.emitBytes(setOp, byte(arg))
 	} else {
@@ -479,6 +1076,72 @@ func (compiler *Compiler) namedVariable(token Token, canAssign bool) {
 	}
 }
 
+// globalVariable emits a global access, whose name may be any constant
+// in the chunk.
+func (compiler *Compiler) globalVariable(token Token, canAssign bool) {
+	name := compiler.identifierConstant(&token)
+	if compiler.matchAssignment(canAssign) {
+		compiler.expression()
+		compiler.emitConstantOperand(OpSetGlobal, name)
+	} else {
+		compiler.emitConstantOperand(OpGetGlobal, name)
+	}
+}
+
+// matchAssignment consumes the '=' of an assignment, if one is allowed
+// here, and remembers it for the condition check.
+func (compiler *Compiler) matchAssignment(canAssign bool) bool {
+	if !canAssign || !compiler.match(TokenEqual) {
+		return false
+	}
+	compiler.assignment = compiler.previous
+	return true
+}
+
+// wideLocal emits a local access for slots that don't fit in one byte.
+func (compiler *Compiler) wideLocal(slot int, canAssign bool) {
+	op := OpGetLocalLong
+	if compiler.matchAssignment(canAssign) {
+		compiler.expression()
+		op = OpSetLocalLong
+	}
+	compiler.emitByte(byte(op))
+	compiler.emitBytes(byte((slot>>8)&0xff), byte(slot&0xff))
+}
+
+func (compiler *Compiler) resolveUpvalue(token Token) int {
+	if compiler.enclosing == nil {
+		return -1
+	}
+	if local := compiler.enclosing.resolveLocal(token); local != -1 {
+		if local > 0xff {
+			compiler.error("Can't capture a local variable past slot 255.")
+			return -1
+		}
+		compiler.enclosing.locals[local].isCaptured = true
+		return compiler.addUpvalue(local, true)
+	}
+	if upvalue := compiler.enclosing.resolveUpvalue(token); upvalue != -1 {
+		return compiler.addUpvalue(upvalue, false)
+	}
+	return -1
+}
+
+func (compiler *Compiler) addUpvalue(index int, isLocal bool) int {
+	for i, upvalue := range compiler.upvalues {
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
+		}
+	}
+	if len(compiler.upvalues) == 256 {
+		compiler.error("Too many closure variables in function.")
+		return 0
+	}
+	compiler.upvalues = append(compiler.upvalues, Upvalue{index, isLocal})
+	compiler.function.upvalueCount++
+	return len(compiler.upvalues) - 1
+}
+
 func (compiler *Compiler) resolveLocal(token Token) int {
 	for i := len(compiler.locals) - 1; i >= 0; i-- {
 		local := compiler.locals[i]
@@ -497,6 +1160,7 @@ func (compiler *Compiler) and(_ bool) {
 	compiler.emitByte(byte(OpPop))
 	compiler.parsePrecedence(PrecedenceAnd)
 	compiler.patchJump(endJump)
+	compiler.stringExpr = false
 }
 
 func (compiler *Compiler) or(_ bool) {
@@ -506,52 +1170,62 @@ func (compiler *Compiler) or(_ bool) {
 	compiler.emitByte(byte(OpPop))
 	compiler.parsePrecedence(PrecedenceOr)
 	compiler.patchJump(endJump)
+	compiler.stringExpr = false
 }
 
-func (compiler *Compiler) getRule(tokenType TokenType) ParseRule {
-	rules := map[TokenType]ParseRule{
-		TokenLeftParen:    {compiler.grouping, nil, PrecedenceNone},
+// rules is the Pratt parser table, indexed by token type. It is filled in
+// by init because the handlers refer back to it through getRule.
+var rules [TokenEOF + 1]ParseRule
+
+func init() {
+	rules = [...]ParseRule{
+		TokenLeftParen:    {(*Compiler).grouping, (*Compiler).call, PrecedenceCall},
 		TokenRightParen:   {nil, nil, PrecedenceNone},
 		TokenLeftBrace:    {nil, nil, PrecedenceNone},
 		TokenRightBrace:   {nil, nil, PrecedenceNone},
 		TokenComma:        {nil, nil, PrecedenceNone},
-		TokenDot:          {nil, nil, PrecedenceNone},
-		TokenMinus:        {compiler.unary, compiler.binary, PrecedenceTerm},
-		TokenPlus:         {nil, compiler.binary, PrecedenceTerm},
+		TokenDot:          {nil, (*Compiler).dot, PrecedenceCall},
+		TokenMinus:        {(*Compiler).unary, (*Compiler).binary, PrecedenceTerm},
+		TokenPlus:         {nil, (*Compiler).binary, PrecedenceTerm},
 		TokenSemicolon:    {nil, nil, PrecedenceNone},
-		TokenSlash:        {nil, compiler.binary, PrecedenceFactor},
-		TokenStar:         {nil, compiler.binary, PrecedenceFactor},
-		TokenBang:         {compiler.unary, nil, PrecedenceNone},
-		TokenBangEqual:    {nil, compiler.binary, PrecedenceEquality},
+		TokenSlash:        {nil, (*Compiler).binary, PrecedenceFactor},
+		TokenStar:         {nil, (*Compiler).binary, PrecedenceFactor},
+		TokenPercent:      {nil, (*Compiler).binary, PrecedenceFactor},
+		TokenStarStar:     {nil, (*Compiler).binary, PrecedenceExponent},
+		TokenBang:         {(*Compiler).unary, nil, PrecedenceNone},
+		TokenBangEqual:    {nil, (*Compiler).binary, PrecedenceEquality},
 		TokenEqual:        {nil, nil, PrecedenceNone},
-		TokenEqualEqual:   {nil, compiler.binary, PrecedenceEquality},
-		TokenGreater:      {nil, compiler.binary, PrecedenceComparison},
-		TokenGreaterEqual: {nil, compiler.binary, PrecedenceComparison},
-		TokenLess:         {nil, compiler.binary, PrecedenceComparison},
-		TokenLessEqual:    {nil, compiler.binary, PrecedenceComparison},
-		TokenIdentifier:   {compiler.variable, nil, PrecedenceNone},
-		TokenString:       {compiler.string, nil, PrecedenceNone},
-		TokenNumber:       {compiler.number, nil, PrecedenceNone},
-		TokenAnd:          {nil, compiler.and, PrecedenceAnd},
+		TokenEqualEqual:   {nil, (*Compiler).binary, PrecedenceEquality},
+		TokenGreater:      {nil, (*Compiler).binary, PrecedenceComparison},
+		TokenGreaterEqual: {nil, (*Compiler).binary, PrecedenceComparison},
+		TokenLess:         {nil, (*Compiler).binary, PrecedenceComparison},
+		TokenLessEqual:    {nil, (*Compiler).binary, PrecedenceComparison},
+		TokenIdentifier:   {(*Compiler).variable, nil, PrecedenceNone},
+		TokenString:       {(*Compiler).string, nil, PrecedenceNone},
+		TokenNumber:       {(*Compiler).number, nil, PrecedenceNone},
+		TokenAnd:          {nil, (*Compiler).and, PrecedenceAnd},
 		TokenClass:        {nil, nil, PrecedenceNone},
 		TokenElse:         {nil, nil, PrecedenceNone},
-		TokenFalse:        {compiler.literal, nil, PrecedenceNone},
+		TokenFalse:        {(*Compiler).literal, nil, PrecedenceNone},
 		TokenFor:          {nil, nil, PrecedenceNone},
 		TokenFun:          {nil, nil, PrecedenceNone},
 		TokenIf:           {nil, nil, PrecedenceNone},
-		TokenNil:          {compiler.literal, nil, PrecedenceNone},
-		TokenOr:           {nil, compiler.or, PrecedenceOr},
+		TokenNil:          {(*Compiler).literal, nil, PrecedenceNone},
+		TokenOr:           {nil, (*Compiler).or, PrecedenceOr},
 		TokenPrint:        {nil, nil, PrecedenceNone},
 		TokenReturn:       {nil, nil, PrecedenceNone},
-		TokenSuper:        {nil, nil, PrecedenceNone},
-		TokenThis:         {nil, nil, PrecedenceNone},
-		TokenTrue:         {compiler.literal, nil, PrecedenceNone},
+		TokenSuper:        {(*Compiler).super, nil, PrecedenceNone},
+		TokenThis:         {(*Compiler).this, nil, PrecedenceNone},
+		TokenTrue:         {(*Compiler).literal, nil, PrecedenceNone},
 		TokenVar:          {nil, nil, PrecedenceNone},
 		TokenWhile:        {nil, nil, PrecedenceNone},
 		TokenError:        {nil, nil, PrecedenceNone},
 		TokenEOF:          {nil, nil, PrecedenceNone},
 	}
-	return rules[tokenType]
+}
+
+func (compiler *Compiler) getRule(tokenType TokenType) *ParseRule {
+	return &rules[tokenType]
 }
 
 type Precedence int
@@ -565,13 +1239,14 @@ const (
 	PrecedenceComparison
 	PrecedenceTerm
 	PrecedenceFactor
+	PrecedenceExponent
 	PrecedenceUnary
 	PrecedenceCall
 	PrecedencePrimary
 )
 
 type ParseRule struct {
-	prefix     func(canAssign bool)
-	infix      func(canAssign bool)
+	prefix     func(compiler *Compiler, canAssign bool)
+	infix      func(compiler *Compiler, canAssign bool)
 	precedence Precedence
 }
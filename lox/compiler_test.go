@@ -0,0 +1,469 @@
+package lox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestImmediateNumbers(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []byte
+	}{
+		{"0;", []byte{byte(OpImmediate), 0}},
+		{"127;", []byte{byte(OpImmediate), 127}},
+		{"-127;", []byte{byte(OpImmediate), 127, byte(OpNegate)}},
+		// 128 doesn't fit in an int8, so it needs a constant even when
+		// negated.
+		{"128;", []byte{byte(OpConstant), 0}},
+		{"-128;", []byte{byte(OpConstant), 0, byte(OpNegate)}},
+		{"2.5;", []byte{byte(OpConstant), 0}},
+		// A whole float stays a float, so it needs a constant too.
+		{"1.0;", []byte{byte(OpConstant), 0}},
+	}
+	for _, test := range tests {
+		chunk := mustCompile(t, test.source)
+		if !bytes.HasPrefix(chunk.code, test.want) {
+			t.Errorf("%q compiled to %v, want it to start with %v", test.source, chunk.code, test.want)
+		}
+		if len(chunk.constants) != countOp(chunk, OpConstant) {
+			t.Errorf("%q has %d constants", test.source, len(chunk.constants))
+		}
+	}
+}
+
+func TestImmediateNumberValues(t *testing.T) {
+	vm := NewVm()
+	if result := vm.Interpret("var a = 127; var b = 128; var c = -128; var d = -129; var e = 0.5;"); result != InterpretOk {
+		t.Fatalf("Interpret = %d", result)
+	}
+	want := map[StringValue]Value{"a": IntValue(127), "b": IntValue(128), "c": IntValue(-128), "d": IntValue(-129), "e": NumberValue(0.5)}
+	for name, value := range want {
+		if globalValue(vm, name) != value {
+			t.Errorf("%s = %v, want %v", name, globalValue(vm, name), value)
+		}
+	}
+
+	// The operand is signed, so the lowest immediate is -128.
+	chunk := chunkOf(byte(OpImmediate), 0x80, byte(OpDefineGlobal), 0, byte(OpNil), byte(OpReturn))
+	chunk.AddConstant(StringValue("low"))
+	vm = NewVm()
+	if result := runChunk(vm, chunk); result != InterpretOk || globalValue(vm, "low") != IntValue(-128) {
+		t.Errorf("OP_IMMEDIATE 0x80 pushed %v, want -128", globalValue(vm, "low"))
+	}
+}
+
+func TestLogicalOperatorPrecedence(t *testing.T) {
+	tests := []struct {
+		source string
+		want   Value
+	}{
+		// Each would give the opposite if 'or' bound tighter than 'and'.
+		{"true or true and false", BoolValue(true)},
+		{"false and false or true", BoolValue(true)},
+		{"false and true or true and false", BoolValue(false)},
+		{"nil or \"default\"", StringValue("default")},
+		{"\"left\" and \"right\"", StringValue("right")},
+		{"false or 5", IntValue(5)},
+	}
+	for _, test := range tests {
+		globals := globalsAfter(t, "var result = "+test.source+";")
+		if globals["result"] != test.want {
+			t.Errorf("%s = %v, want %v", test.source, globals["result"], test.want)
+		}
+	}
+}
+
+func TestLogicalOperatorsShortCircuit(t *testing.T) {
+	globals := globalsAfter(t, `
+		var touched = false;
+		var a = true or (touched = true);
+		var b = false and (touched = true);
+		var skipped = !touched;
+		var c = false or (touched = "or");
+		var d = true and touched;
+		// The skipped operands would be runtime errors.
+		var e = true or undefined;
+		var f = false and undefined;
+	`)
+	want := map[StringValue]Value{"touched": StringValue("or"), "a": BoolValue(true), "b": BoolValue(false),
+		"skipped": BoolValue(true), "c": StringValue("or"), "d": StringValue("or"), "e": BoolValue(true), "f": BoolValue(false)}
+	for name, value := range want {
+		if globals[name] != value {
+			t.Errorf("%s = %v, want %v", name, globals[name], value)
+		}
+	}
+}
+
+func TestNotFusesIntoEquality(t *testing.T) {
+	tests := []struct {
+		expression string
+		has        []OpCode
+		lacks      []OpCode
+	}{
+		{"!(a == b)", []OpCode{OpNotEqual}, []OpCode{OpNot, OpEqual}},
+		{"!(a != b)", []OpCode{OpEqual}, []OpCode{OpNot, OpNotEqual}},
+		{"!!(a == b)", []OpCode{OpEqual}, []OpCode{OpNot, OpNotEqual}},
+		// With NaN, !(a < b) is not a >= b.
+		{"!(a < b)", []OpCode{OpLess, OpNot}, []OpCode{OpGreaterEqual}},
+		{"!(a <= b)", []OpCode{OpLessEqual, OpNot}, []OpCode{OpGreater}},
+		// The value of an 'and' doesn't come from its last instruction.
+		{"!(a and b == a)", []OpCode{OpEqual, OpNot}, nil},
+		{"!a", []OpCode{OpNot}, nil},
+	}
+	for _, test := range tests {
+		chunk := mustCompile(t, "var a; var b; var result = "+test.expression+";")
+		for _, op := range test.has {
+			if countOp(chunk, op) == 0 {
+				t.Errorf("%s compiled without %s: %v", test.expression, op, opcodes(chunk))
+			}
+		}
+		for _, op := range test.lacks {
+			if countOp(chunk, op) != 0 {
+				t.Errorf("%s compiled with %s: %v", test.expression, op, opcodes(chunk))
+			}
+		}
+	}
+}
+
+func TestFusedNotGivesTheSameResults(t *testing.T) {
+	operands := []string{"1", "2", "nil", "false", "\"a\"", "0 / 0"}
+	for _, a := range operands {
+		for _, b := range operands {
+			globals := globalsAfter(t, `
+				var a = `+a+`; var b = `+b+`;
+				var equal = a == b; var unequal = a != b;
+				var fused = !(a == b); var unfused = !equal;
+				var fusedNe = !(a != b); var unfusedNe = !unequal;
+			`)
+			if globals["fused"] != globals["unfused"] || globals["fusedNe"] != globals["unfusedNe"] {
+				t.Errorf("a = %s, b = %s: fused %v and %v, unfused %v and %v", a, b,
+					globals["fused"], globals["fusedNe"], globals["unfused"], globals["unfusedNe"])
+			}
+		}
+	}
+}
+
+func TestCompileErrorsReportInSourceOrder(t *testing.T) {
+	source := "var = 1;\nprint 1;\nprint 2;\nprint 3;\nprint +;\nfun f() {\n  print 4;\n  var x = 1;\n  x = ;\n}\n"
+	vm, _, _ := newTestVm()
+	if result := vm.Interpret(source); result != InterpretCompileError {
+		t.Fatalf("Interpret = %d, want InterpretCompileError", result)
+	}
+	want := []string{
+		"[line 1, col 5] Error at '=': Expect variable name.",
+		"[line 5, col 7] Error at '+': Expect expression.",
+		"[line 9, col 7] Error at ';': Expect expression.",
+	}
+	if errors := vm.Errors(); strings.Join(errors, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Errors() = %q, want %q", errors, want)
+	}
+}
+
+// manyConstants returns statements that fill the constant pool with n
+// distinct numbers.
+func manyConstants(n int) string {
+	var source strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&source, "%d.5;\n", i)
+	}
+	return source.String()
+}
+
+func TestManyConstants(t *testing.T) {
+	terms := make([]string, 300)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("%d.5", i)
+	}
+	// Starting from a variable keeps the additions from being folded. The
+	// two names take the first constants, so 46 of the literals need more
+	// than a byte.
+	source := "var x = 0;\nvar total = x + " + strings.Join(terms, " + ") + ";"
+	chunk := mustCompile(t, source)
+	if got := countOp(chunk, OpConstantLong); got != 46 {
+		t.Errorf("OP_CONSTANT_LONG count = %d, want 46", got)
+	}
+	if err := chunk.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	if total := globalsAfter(t, source)["total"]; total != NumberValue(45000) {
+		t.Errorf("total = %v, want 45000", total)
+	}
+}
+
+func TestConcatForKnownStrings(t *testing.T) {
+	tests := []struct {
+		source  string
+		concats int
+		adds    int
+	}{
+		{`var s = "a" + "b";`, 1, 0},
+		{`var s = "a" + "b" + "c";`, 2, 0},
+		{`var s = ("a" + "b") + "c";`, 2, 0},
+		{`var x; var s = (x = "a") + "b";`, 1, 0},
+		{`var s = "a" + 1;`, 0, 1},
+		{`var x = "a"; var s = x + "b";`, 0, 1},
+		{`var n = 1; var s = n + 2;`, 0, 1},
+		{`fun f() { return "a"; } var s = f() + "b";`, 0, 1},
+	}
+	for _, test := range tests {
+		chunk := mustCompile(t, test.source)
+		if got := countOp(chunk, OpConcat); got != test.concats {
+			t.Errorf("%s: %d OP_CONCAT, want %d", test.source, got, test.concats)
+		}
+		if got := countOp(chunk, OpAdd); got != test.adds {
+			t.Errorf("%s: %d OP_ADD, want %d", test.source, got, test.adds)
+		}
+	}
+
+	globals := globalsAfter(t, `var x; var s = ("a" + "b") + (x = "c") + "d";`)
+	if globals["s"] != StringValue("abcd") {
+		t.Errorf(`s = %v, want "abcd"`, globals["s"])
+	}
+}
+
+func TestAssignmentInConditionWarning(t *testing.T) {
+	const warning = "Warning: Assignment used as a condition; use '==' to compare or wrap it in parentheses."
+	vm, out, errOut := newTestVm()
+	vm.SetAssignmentCheck(AssignmentCheckWarn)
+	if result := vm.Interpret("var x = 1;\nif (x = 5) print x;\n"); result != InterpretOk {
+		t.Fatalf("Interpret = %d, want InterpretOk", result)
+	}
+	want := "[line 2, col 7] " + warning + "\n    if (x = 5) print x;\n          ^\n"
+	if errOut.String() != want {
+		t.Errorf("warned %q, want %q", errOut, want)
+	}
+	if out.String() != "5\n" {
+		t.Errorf("printed %q, want %q", out, "5\n")
+	}
+
+	for _, source := range []string{
+		"var x; while (x = false) {}",
+		"class C {} var c = C(); if (c.flag = true) {}",
+		"fun f() { var x; if (x = 1) {} }",
+	} {
+		errOut.Reset()
+		vm.Interpret(source)
+		if !strings.Contains(errOut.String(), warning) {
+			t.Errorf("%q did not warn; got %q", source, errOut)
+		}
+	}
+}
+
+func TestParenthesizedAssignmentInCondition(t *testing.T) {
+	for _, source := range []string{
+		"var x; if ((x = 5)) print x;",
+		"var x; while ((x = false)) {}",
+		"var x; if (x == 5) print x;",
+	} {
+		vm, _, errOut := newTestVm()
+		vm.SetAssignmentCheck(AssignmentCheckError)
+		if result := vm.Interpret(source); result != InterpretOk {
+			t.Errorf("%q = %d, want InterpretOk; errors:\n%s", source, result, errOut)
+		}
+	}
+}
+
+func TestAssignmentInConditionError(t *testing.T) {
+	vm, _, _ := newTestVm()
+	vm.SetAssignmentCheck(AssignmentCheckError)
+	if result := vm.Interpret("var x = 1;\nif (x = 5) print x;"); result != InterpretCompileError {
+		t.Fatalf("Interpret = %d, want InterpretCompileError", result)
+	}
+	want := "[line 2, col 7] Error at '=': Assignment used as a condition; use '==' to compare or wrap it in parentheses."
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != want {
+		t.Errorf("Errors() = %q, want %q", errors, want)
+	}
+
+	vm.SetAssignmentCheck(AssignmentCheckOff)
+	if result := vm.Interpret("var x = 1; if (x = 5) {}"); result != InterpretOk {
+		t.Errorf("with the check off, Interpret = %d", result)
+	}
+}
+
+func TestTopLevelReturn(t *testing.T) {
+	vm, out, _ := newTestVm()
+	if result := vm.Interpret("print 1;\nreturn 2;"); result != InterpretCompileError {
+		t.Fatalf("Interpret = %d, want InterpretCompileError", result)
+	}
+	want := "[line 2, col 1] Error at 'return': Can't return from top-level code."
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != want {
+		t.Errorf("Errors() = %q, want %q", errors, want)
+	}
+	if out.Len() != 0 {
+		t.Errorf("printed %q, want nothing", out)
+	}
+
+	// The same statement is fine inside functions and methods, and the Vm
+	// keeps working after the error.
+	source := `
+		fun f() { return 2; }
+		class C { m() { return 3; } init() { return; } }
+		print f() + C().m();
+	`
+	if result := vm.Interpret(source); result != InterpretOk || out.String() != "5\n" {
+		t.Errorf("Interpret = %d printing %q, want 5", result, out)
+	}
+}
+
+func TestErrorShowsSourceLineWithCaret(t *testing.T) {
+	vm, _, errOut := newTestVm()
+	vm.Interpret("var a = 1;\n\t\tprint a +\t;\n")
+	want := "[line 2, col 13] Error at ';': Expect expression.\n" +
+		"    \t\tprint a +\t;\n" +
+		"    \t\t         \t^\n"
+	if errOut.String() != want {
+		t.Errorf("reported:\n%s\nwant:\n%s", errOut, want)
+	}
+
+	errOut.Reset()
+	vm.Interpret("print 1 + unknown\n  ;\nvar 1x;")
+	want = "[line 3, col 5] Error at '1': Expect variable name.\n" +
+		"    var 1x;\n" +
+		"        ^\n"
+	if errOut.String() != want {
+		t.Errorf("reported:\n%s\nwant:\n%s", errOut, want)
+	}
+}
+
+func TestCompileReportsEveryError(t *testing.T) {
+	source := "var = 1;\nprint 1 +;\nvar ok = 2;\nfun f( { }\nprint ok;"
+	var err error
+	capture(t, &os.Stderr, func() { _, err = Compile(source) })
+	compileError, ok := err.(*CompileError)
+	if !ok {
+		t.Fatalf("Compile() = %v, want a *CompileError", err)
+	}
+	want := []string{
+		"[line 1, col 5] Error at '=': Expect variable name.",
+		"[line 2, col 10] Error at ';': Expect expression.",
+		"[line 4, col 8] Error at '{': Expect parameter name.",
+	}
+	if strings.Join(compileError.Errors, "\n") != strings.Join(want, "\n") {
+		t.Errorf("errors:\n%s\nwant:\n%s", compileError, strings.Join(want, "\n"))
+	}
+
+	vm, _, _ := newTestVm()
+	if result := vm.Interpret(source); result != InterpretCompileError || len(vm.Errors()) != 3 {
+		t.Errorf("Interpret = %d with errors %q", result, vm.Errors())
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	chunk := mustCompile(t, "var day = 60 * 60 * 24;")
+	for _, op := range []OpCode{OpMultiply, OpAdd, OpImmediate} {
+		if got := countOp(chunk, op); got != 0 {
+			t.Errorf("%d %s, want none", got, op)
+		}
+	}
+	// Only the global's name and the folded result are left in the pool.
+	if len(chunk.constants) != 2 || chunk.constants[1] != IntValue(86400) {
+		t.Errorf("constants = %v, want [day 86400]", chunk.constants)
+	}
+
+	// Division by zero, operators other than + - * / and operands that
+	// aren't literals are left alone.
+	unfolded := []struct {
+		source string
+		op     OpCode
+	}{
+		{"var q = 1 / 0;", OpDivide},
+		{"var m = 7 % 2;", OpModulo},
+		{"var n = 1; var s = n * 2;", OpMultiply},
+	}
+	for _, test := range unfolded {
+		if got := countOp(mustCompile(t, test.source), test.op); got != 1 {
+			t.Errorf("%s: %d %s, want 1", test.source, got, test.op)
+		}
+	}
+	expectOutput(t, "print 1 + 2 * 3 - 4 / 8; print 1 / 0;", "6.5\n+Inf\n")
+}
+
+func TestIdentifiersShareAConstant(t *testing.T) {
+	chunk := mustCompile(t, `var count = 0; count = count + 1; print count; print "count";`)
+	names := 0
+	for _, constant := range chunk.constants {
+		if constant == StringValue("count") {
+			names++
+		}
+	}
+	// The string literal is a separate constant from the name.
+	if names != 2 {
+		t.Errorf("constants = %v, want the name once and the literal once", chunk.constants)
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	source := strings.Repeat("print;\n", 30)
+	vm, _, errOut := newTestVm()
+	if result := vm.Interpret(source); result != InterpretCompileError {
+		t.Fatalf("Interpret = %d, want InterpretCompileError", result)
+	}
+	errors := vm.Errors()
+	if len(errors) != DefaultMaxErrors+1 {
+		t.Fatalf("reported %d errors, want %d and a summary", len(errors), DefaultMaxErrors)
+	}
+	summary := "Too many errors; stopping after 20."
+	if errors[len(errors)-1] != summary || !strings.HasSuffix(errOut.String(), summary+"\n") {
+		t.Errorf("last error is %q, want %q", errors[len(errors)-1], summary)
+	}
+
+	vm.SetMaxErrors(3)
+	vm.Interpret(source)
+	if errors := vm.Errors(); len(errors) != 4 || errors[3] != "Too many errors; stopping after 3." {
+		t.Errorf("with a limit of 3, Errors() = %q", errors)
+	}
+
+	vm.SetMaxErrors(0)
+	vm.Interpret(source)
+	if errors := vm.Errors(); len(errors) != 30 {
+		t.Errorf("with no limit, reported %d errors, want 30", len(errors))
+	}
+}
+
+func TestNamesPastTheFirst256Constants(t *testing.T) {
+	source := manyConstants(300) + `
+		var zz = 1;
+		zz = zz + 1;
+		print zz;
+		class Animal {
+			speak() { return "..."; }
+		}
+		class Dog < Animal {
+			init(name) { this.name = name; }
+			speak() { return this.name + " says " + super.speak(); }
+		}
+		var dog = Dog("rex");
+		dog.name = "fido";
+		print dog.speak();
+		fun add(a, b) { return a + b; }
+		print add(1, 2);
+		class Puppy < Dog {
+			speak() {
+				` + manyConstants(300) + `
+				return super.speak() + "!";
+			}
+		}
+		print Puppy("rex").speak();
+	`
+	expectOutput(t, source, "2\nfido says ...\n3\nrex says ...!\n")
+
+	chunk, err := Compile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	var disassembly strings.Builder
+	chunk.DisassembleTo(&disassembly, "script")
+	for _, op := range []OpCode{OpDefineGlobalLong, OpGetGlobalLong, OpSetGlobalLong, OpClassLong, OpMethodLong, OpClosureLong,
+		OpGetPropertyLong, OpSetPropertyLong} {
+		if !strings.Contains(disassembly.String(), op.String()) {
+			t.Errorf("disassembly does not contain %s", op)
+		}
+	}
+}
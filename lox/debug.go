@@ -1,106 +1,182 @@
 package lox
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
 
+// Disassemble prints the chunk's instructions to stdout under a header
+// with the given name.
 func (chunk *Chunk) Disassemble(name string) {
-	fmt.Printf("== %s ==\n", name)
+	chunk.DisassembleTo(os.Stdout, name)
+}
+
+// DisassembleTo writes the chunk's instructions to w under a header with
+// the given name.
+func (chunk *Chunk) DisassembleTo(w io.Writer, name string) {
+	fmt.Fprintf(w, "== %s ==\n", name)
 	for offset := 0; offset < len(chunk.code); {
-		offset = chunk.disassembleInstruction(offset)
+		offset = chunk.disassembleInstruction(w, offset)
 	}
 }
 
-func (chunk *Chunk) disassembleInstruction(offset int) int {
-	fmt.Printf("%04d ", offset)
+func (chunk *Chunk) disassembleInstruction(w io.Writer, offset int) int {
+	fmt.Fprintf(w, "%04d ", offset)
 	if offset > 0 && chunk.lines[offset] == chunk.lines[offset-1] {
-		fmt.Printf("   | ")
+		fmt.Fprintf(w, "   | ")
 	} else {
-		fmt.Printf("%4d ", chunk.lines[offset])
+		fmt.Fprintf(w, "%4d ", chunk.lines[offset])
 	}
 
-	instruction := chunk.code[offset]
-	switch OpCode(instruction) {
-	case OpReturn:
-		return chunk.simpleInstruction("OP_RETURN", offset)
-	case OpConstant:
-		return chunk.constantInstruction("OP_CONSTANT", offset)
-	case OpNegate:
-		return chunk.simpleInstruction("OP_NEGATE", offset)
-	case OpAdd:
-		return chunk.simpleInstruction("OP_ADD", offset)
-	case OpSubtract:
-		return chunk.simpleInstruction("OP_SUBTRACT", offset)
-	case OpMultiply:
-		return chunk.simpleInstruction("OP_MULTIPLY", offset)
-	case OpDivide:
-		return chunk.simpleInstruction("OP_DIVIDE", offset)
-	case OpNil:
-		return chunk.simpleInstruction("OP_NIL", offset)
-	case OpTrue:
-		return chunk.simpleInstruction("OP_TRUE", offset)
-	case OpFalse:
-		return chunk.simpleInstruction("OP_FALSE", offset)
-	case OpNot:
-		return chunk.simpleInstruction("OP_NOT", offset)
-	case OpEqual:
-		return chunk.simpleInstruction("OP_EQUAL", offset)
-	case OpNotEqual:
-		return chunk.simpleInstruction("OP_NOT_EQUAL", offset)
-	case OpGreater:
-		return chunk.simpleInstruction("OP_GREATER", offset)
-	case OpGreaterEqual:
-		return chunk.simpleInstruction("OP_GREATER_EQUAL", offset)
-	case OpLess:
-		return chunk.simpleInstruction("OP_LESS", offset)
-	case OpLessEqual:
-		return chunk.simpleInstruction("OP_LESS_EQUAL", offset)
-	case OpPrint:
-		return chunk.simpleInstruction("OP_PRINT", offset)
-	case OpPop:
-		return chunk.simpleInstruction("OP_POP", offset)
-	case OpDefineGlobal:
-		return chunk.constantInstruction("OP_DEFINE_GLOBAL", offset)
-	case OpGetGlobal:
-		return chunk.constantInstruction("OP_GET_GLOBAL", offset)
-	case OpSetGlobal:
-		return chunk.constantInstruction("OP_SET_GLOBAL", offset)
-	case OpGetLocal:
-		return chunk.byteInstruction("OP_GET_LOCAL", offset)
-	case OpSetLocal:
-		return chunk.byteInstruction("OP_SET_LOCAL", offset)
-	case OpJump:
-		return chunk.jumpInstruction("OP_JUMP", 1, offset)
-	case OpJumpIfFalse:
-		return chunk.jumpInstruction("OP_JUMP_IF_FALSE", 1, offset)
+	instruction := OpCode(chunk.code[offset])
+	switch instruction {
+	case OpConstant, OpDefineGlobal, OpGetGlobal, OpSetGlobal, OpClass, OpGetProperty, OpSetProperty, OpMethod,
+		OpGetSuper:
+		return chunk.constantInstruction(w, instruction.String(), offset)
+	case OpConstantLong, OpDefineGlobalLong, OpGetGlobalLong, OpSetGlobalLong, OpClassLong, OpGetPropertyLong,
+		OpSetPropertyLong, OpMethodLong, OpGetSuperLong:
+		return chunk.constantLongInstruction(w, instruction.String(), offset)
+	case OpGetLocal, OpSetLocal, OpCall, OpGetUpvalue, OpSetUpvalue:
+		return chunk.byteInstruction(w, instruction.String(), offset)
+	case OpClosure, OpClosureLong:
+		return chunk.closureInstruction(w, instruction.String(), offset)
+	case OpImmediate:
+		return chunk.immediateInstruction(w, instruction.String(), offset)
+	case OpGetLocalLong, OpSetLocalLong:
+		return chunk.shortInstruction(w, instruction.String(), offset)
+	case OpJump, OpJumpIfFalse:
+		return chunk.jumpInstruction(w, instruction.String(), 1, offset)
 	case OpLoop:
-		return chunk.jumpInstruction("OP_LOOP", -1, offset)
+		return chunk.jumpInstruction(w, instruction.String(), -1, offset)
 	default:
-		fmt.Printf("Unknown opcode %d\n", instruction)
-		return offset + 1
+		if operandCount(instruction) == -1 {
+			fmt.Fprintf(w, "Unknown opcode %d\n", instruction)
+			return offset + 1
+		}
+		return chunk.simpleInstruction(w, instruction.String(), offset)
 	}
 }
 
-func (chunk *Chunk) simpleInstruction(name string, offset int) int {
-	fmt.Printf("%s\n", name)
+func (chunk *Chunk) simpleInstruction(w io.Writer, name string, offset int) int {
+	fmt.Fprintf(w, "%s\n", name)
 	return offset + 1
 }
 
-func (chunk *Chunk) constantInstruction(name string, offset int) int {
+func (chunk *Chunk) constantInstruction(w io.Writer, name string, offset int) int {
 	constant := chunk.code[offset+1]
-	fmt.Printf("%-16s %4d '", name, constant)
-	chunk.constants[constant].print()
-	fmt.Printf("'\n")
+	fmt.Fprintf(w, "%-16s %4d '%s'\n", name, constant, chunk.constants[constant])
 	return offset + 2
 }
 
-func (chunk *Chunk) byteInstruction(name string, offset int) int {
+func (chunk *Chunk) constantLongInstruction(w io.Writer, name string, offset int) int {
+	constant := chunk.constantLong(offset)
+	fmt.Fprintf(w, "%-16s %4d '%s'\n", name, constant, chunk.constants[constant])
+	return offset + 4
+}
+
+func (chunk *Chunk) byteInstruction(w io.Writer, name string, offset int) int {
 	slot := chunk.code[offset+1]
-	fmt.Printf("%-16s %4d\n", name, slot)
+	fmt.Fprintf(w, "%-16s %4d\n", name, slot)
+	return offset + 2
+}
+
+func (chunk *Chunk) closureInstruction(w io.Writer, name string, offset int) int {
+	constant, _ := chunk.constantOperand(offset)
+	function := chunk.constants[constant].(*FunctionValue)
+	fmt.Fprintf(w, "%-16s %4d %s\n", name, constant, function)
+	offset += 1 + operandCount(OpCode(chunk.code[offset]))
+	for i := 0; i < function.upvalueCount; i++ {
+		kind := "upvalue"
+		if chunk.code[offset] == 1 {
+			kind = "local"
+		}
+		fmt.Fprintf(w, "%04d    |                     %s %d\n", offset, kind, chunk.code[offset+1])
+		offset += 2
+	}
+	return offset
+}
+
+func (chunk *Chunk) immediateInstruction(w io.Writer, name string, offset int) int {
+	value := int8(chunk.code[offset+1])
+	fmt.Fprintf(w, "%-16s %4d\n", name, value)
 	return offset + 2
 }
 
-func (chunk *Chunk) jumpInstruction(name string, sign int, offset int) int {
+func (chunk *Chunk) shortInstruction(w io.Writer, name string, offset int) int {
+	slot := int(chunk.code[offset+1])<<8 | int(chunk.code[offset+2])
+	fmt.Fprintf(w, "%-16s %4d\n", name, slot)
+	return offset + 3
+}
+
+func (chunk *Chunk) jumpInstruction(w io.Writer, name string, sign int, offset int) int {
 	jump := int(chunk.code[offset+1]) << 8
 	jump |= int(chunk.code[offset+2])
-	fmt.Printf("%-16s %4d -> %d\n", name, offset, offset+3+sign*jump)
+	fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, offset+3+sign*jump)
 	return offset + 3
 }
+
+// ControlFlowDOT splits the chunk into basic blocks at jump targets and
+// after jumps and returns, and renders the resulting control-flow graph
+// in Graphviz DOT format.
+func (chunk *Chunk) ControlFlowDOT() string {
+	leaders := map[int]bool{0: true}
+	for offset := 0; offset < len(chunk.code); {
+		op := OpCode(chunk.code[offset])
+		next := offset + chunk.instructionSize(offset)
+		switch op {
+		case OpJump, OpJumpIfFalse, OpLoop:
+			leaders[chunk.jumpTarget(offset)] = true
+			leaders[next] = true
+		case OpReturn:
+			leaders[next] = true
+		}
+		offset = next
+	}
+
+	var out strings.Builder
+	out.WriteString("digraph chunk {\n")
+	out.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+
+	var edges []string
+	for start := 0; start < len(chunk.code); {
+		var label strings.Builder
+		offset := start
+		var last OpCode
+		for {
+			last = OpCode(chunk.code[offset])
+			fmt.Fprintf(&label, "%04d %s", offset, last)
+			switch last {
+			case OpJump, OpJumpIfFalse, OpLoop:
+				fmt.Fprintf(&label, " -> %d", chunk.jumpTarget(offset))
+			}
+			label.WriteString("\\l")
+			offset += chunk.instructionSize(offset)
+			if offset >= len(chunk.code) || leaders[offset] {
+				break
+			}
+		}
+		fmt.Fprintf(&out, "  b%d [label=\"%s\"];\n", start, label.String())
+
+		switch last {
+		case OpJump, OpLoop:
+			edges = append(edges, fmt.Sprintf("  b%d -> b%d;\n", start, chunk.jumpTarget(offset-3)))
+		case OpJumpIfFalse:
+			edges = append(edges, fmt.Sprintf("  b%d -> b%d [label=\"false\"];\n", start, chunk.jumpTarget(offset-3)))
+			edges = append(edges, fmt.Sprintf("  b%d -> b%d [label=\"true\"];\n", start, offset))
+		case OpReturn:
+		default:
+			if offset < len(chunk.code) {
+				edges = append(edges, fmt.Sprintf("  b%d -> b%d;\n", start, offset))
+			}
+		}
+		start = offset
+	}
+
+	for _, edge := range edges {
+		out.WriteString(edge)
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
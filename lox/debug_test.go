@@ -0,0 +1,89 @@
+package lox
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var dotEdge = regexp.MustCompile(`(?m)^  (b\d+) -> (b\d+)(?: \[label="(\w+)"\])?;$`)
+
+func TestControlFlowDOTBranches(t *testing.T) {
+	dot := mustCompile(t, "var x = true;\nif (x) print 1; else print 2;\nprint 3;").ControlFlowDOT()
+	if !strings.HasPrefix(dot, "digraph chunk {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("not a DOT graph:\n%s", dot)
+	}
+
+	// The condition's block branches to the two arms, which both fall
+	// through to the final print.
+	edges := map[string]map[string]string{}
+	for _, match := range dotEdge.FindAllStringSubmatch(dot, -1) {
+		if edges[match[1]] == nil {
+			edges[match[1]] = map[string]string{}
+		}
+		edges[match[1]][match[3]] = match[2]
+	}
+	condition := "b0"
+	thenArm, elseArm := edges[condition]["true"], edges[condition]["false"]
+	if len(edges[condition]) != 2 || thenArm == "" || elseArm == "" || thenArm == elseArm {
+		t.Fatalf("condition block has edges %v, want a true and a false branch:\n%s", edges[condition], dot)
+	}
+	join := edges[thenArm][""]
+	if len(edges) != 3 || join == "" || edges[elseArm][""] != join || len(edges[join]) != 0 {
+		t.Errorf("the arms don't meet in one block:\n%s", dot)
+	}
+	if !strings.Contains(dot, "  "+thenArm+" [label=\"") || !strings.Contains(dot, "OP_JUMP_IF_FALSE -> ") {
+		t.Errorf("missing blocks or jump labels:\n%s", dot)
+	}
+}
+
+func TestControlFlowDOTLoop(t *testing.T) {
+	dot := mustCompile(t, "var i = 0; while (i < 3) i = i + 1;").ControlFlowDOT()
+	var back bool
+	for _, match := range dotEdge.FindAllStringSubmatch(dot, -1) {
+		// Blocks are named by their offset, and only the loop goes back.
+		from, _ := strconv.Atoi(match[1][1:])
+		to, _ := strconv.Atoi(match[2][1:])
+		if to < from {
+			back = true
+		}
+	}
+	if !back {
+		t.Errorf("no backward edge for the loop:\n%s", dot)
+	}
+}
+
+func TestDisassembleTo(t *testing.T) {
+	chunk := mustCompile(t, "var greeting = \"hi\";\nif (greeting) print 300;")
+	var out strings.Builder
+	chunk.DisassembleTo(&out, "script")
+	want := `== script ==
+0000    1 OP_CONSTANT         1 'hi'
+0002    | OP_DEFINE_GLOBAL    0 'greeting'
+0004    2 OP_GET_GLOBAL       0 'greeting'
+0006    | OP_JUMP_IF_FALSE    6 -> 16
+0009    | OP_POP
+0010    | OP_CONSTANT         2 '300'
+0012    | OP_PRINT
+0013    | OP_JUMP            13 -> 17
+0016    | OP_POP
+0017    | OP_NIL
+0018    | OP_RETURN
+`
+	if out.String() != want {
+		t.Errorf("disassembly:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestDisassembleClosure(t *testing.T) {
+	chunk := mustCompile(t, "{ var a = 1; var b = 2; fun f() { return a + b; } }")
+	var out strings.Builder
+	chunk.DisassembleTo(&out, "script")
+	want := "0004    | OP_CLOSURE          0 <fn f>\n" +
+		"0006    |                     local 1\n" +
+		"0008    |                     local 2\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("disassembly:\n%s\ndoes not contain:\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,76 @@
+package lox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DumpState renders the call frames, the instruction being executed, the
+// stack and the globals, for diagnosing crashes in the VM itself.
+func (vm *Vm) DumpState() string {
+	var out strings.Builder
+	out.WriteString("== vm state ==\n")
+
+	out.WriteString("frames:\n")
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		fmt.Fprintf(&out, "  %s ip %d\n", frame.closure.function, frame.ip)
+	}
+
+	if len(vm.frames) > 0 {
+		frame := vm.frame()
+		chunk := frame.closure.function.chunk
+		if offset := chunk.instructionContaining(frame.ip - 1); offset != -1 {
+			fmt.Fprintf(&out, "instruction: %s\n", chunk.describeInstruction(offset))
+		}
+	}
+
+	out.WriteString("stack:")
+	for _, value := range vm.stack[:vm.stackTop] {
+		fmt.Fprintf(&out, " [ %s ]", value)
+	}
+	out.WriteString("\n")
+
+	names := make([]string, 0, len(vm.globals.cells))
+	for name := range vm.globals.cells {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	out.WriteString("globals:\n")
+	for _, name := range names {
+		fmt.Fprintf(&out, "  %s = %s\n", name, vm.globals.cells[StringValue(name)].value)
+	}
+	return out.String()
+}
+
+// instructionContaining returns the start of the instruction that the
+// byte at offset belongs to, or -1 if there is none.
+func (chunk *Chunk) instructionContaining(offset int) int {
+	if offset < 0 || offset >= len(chunk.code) {
+		return -1
+	}
+	for start := 0; start < len(chunk.code); {
+		size := chunk.instructionSize(start)
+		if size == -1 {
+			return -1
+		}
+		if offset < start+size {
+			return start
+		}
+		start += size
+	}
+	return -1
+}
+
+// describeInstruction renders the instruction at offset on one line as
+// its offset, source line, opcode name and raw operand bytes.
+func (chunk *Chunk) describeInstruction(offset int) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%04d [line %d] %s", offset, chunk.lines[offset], OpCode(chunk.code[offset]))
+	end := offset + chunk.instructionSize(offset)
+	for i := offset + 1; i < end && i < len(chunk.code); i++ {
+		fmt.Fprintf(&out, " %d", chunk.code[i])
+	}
+	return out.String()
+}
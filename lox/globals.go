@@ -0,0 +1,38 @@
+package lox
+
+// Globals holds a Vm's global variables. Each variable lives in its own
+// cell, which never moves once created, so instructions can cache the
+// cell they resolved instead of hashing the name on every access.
+type Globals struct {
+	cells map[StringValue]*globalCell
+}
+
+type globalCell struct {
+	value Value
+}
+
+func NewGlobals() *Globals {
+	return &Globals{cells: map[StringValue]*globalCell{}}
+}
+
+// define creates the variable or, if it already exists, overwrites it in
+// place so cached cells stay valid.
+func (globals *Globals) define(name StringValue, value Value) {
+	if cell, ok := globals.cells[name]; ok {
+		cell.value = value
+		return
+	}
+	globals.cells[name] = &globalCell{value: value}
+}
+
+// resolveGlobal returns the global named by constant index of chunk,
+// using cells as the cache of that chunk's lookups. Hits are cached;
+// misses are not, so a variable defined later is still found.
+func (globals *Globals) resolveGlobal(chunk *Chunk, cells []*globalCell, index int) *globalCell {
+	if cell := cells[index]; cell != nil {
+		return cell
+	}
+	cell := globals.cells[chunk.constants[index].(StringValue)]
+	cells[index] = cell
+	return cell
+}
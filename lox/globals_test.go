@@ -0,0 +1,107 @@
+package lox
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCachedGlobalSeesReassignment(t *testing.T) {
+	globals := globalsAfter(t, `
+		var step = 1;
+		var total = 0;
+		for (var i = 0; i < 6; i = i + 1) {
+			total = total + step;
+			if (i == 2) step = 10;
+		}
+	`)
+	if globals["total"] != IntValue(33) {
+		t.Errorf("total = %v, want 33", globals["total"])
+	}
+}
+
+func TestCachedGlobalSeesRedefinition(t *testing.T) {
+	globals := globalsAfter(t, `
+		var value = "first";
+		fun read() { return value; }
+		var first = read();
+		var value = "second";
+		var second = read();
+	`)
+	if globals["first"] != StringValue("first") || globals["second"] != StringValue("second") {
+		t.Errorf("read() gave %v then %v", globals["first"], globals["second"])
+	}
+}
+
+func TestGlobalDefinedAfterAMiss(t *testing.T) {
+	vm, _, _ := newTestVm()
+	if result := vm.Interpret("fun read() { return late; } read();"); result != InterpretRuntimeError {
+		t.Fatalf("reading an undefined global gave %d, want InterpretRuntimeError", result)
+	}
+	// The failed lookup isn't cached, so defining the variable later
+	// makes it visible to the same function.
+	if result := vm.Interpret("var late = 1; var got = read();"); result != InterpretOk || globalValue(vm, "got") != IntValue(1) {
+		t.Errorf("after defining it, Interpret = %d reading %v", result, globalValue(vm, "got"))
+	}
+}
+
+func TestCachedGlobalsFollowTheVm(t *testing.T) {
+	chunk := mustCompile(t, "print shared;")
+	for _, value := range []Value{IntValue(1), StringValue("two")} {
+		vm, out, _ := newTestVm()
+		vm.SetGlobal("shared", value)
+		vm.RunCompiled(chunk)
+		if want := value.String() + "\n"; out.String() != want {
+			t.Errorf("printed %q, want %q", out, want)
+		}
+	}
+
+	vm, out, _ := newTestVm()
+	vm.SetGlobal("shared", IntValue(1))
+	vm.RunCompiled(chunk)
+	vm.ResetGlobals()
+	vm.SetGlobal("shared", IntValue(2))
+	vm.RunCompiled(chunk)
+	if out.String() != "1\n2\n" {
+		t.Errorf("after ResetGlobals, printed %q, want %q", out, "1\n2\n")
+	}
+}
+
+func TestOneChunkOnTwoVms(t *testing.T) {
+	chunk := mustCompile(t, `
+		var total = 0;
+		for (var i = 0; i < 1000; i = i + 1) total = total + step;
+		print total;
+	`)
+	var wg sync.WaitGroup
+	for _, step := range []int64{1, 2} {
+		vm, out, _ := newTestVm()
+		vm.SetGlobal("step", IntValue(step))
+		wg.Add(1)
+		go func(step int64) {
+			defer wg.Done()
+			if result := vm.RunCompiled(chunk); result != InterpretOk {
+				t.Errorf("RunCompiled = %d; errors %q", result, vm.Errors())
+			}
+			if want := IntValue(1000*step).String() + "\n"; out.String() != want {
+				t.Errorf("step %d printed %q, want %q", step, out, want)
+			}
+		}(step)
+	}
+	wg.Wait()
+}
+
+func BenchmarkStableGlobal(b *testing.B) {
+	vm, _, _ := newTestVm()
+	chunk, err := vm.Compile(`
+		var step = 1;
+		var total = 0;
+		for (var i = 0; i < 10000; i = i + 1) total = total + step;
+	`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.RunCompiled(chunk)
+	}
+}
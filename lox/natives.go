@@ -0,0 +1,495 @@
+package lox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func (vm *Vm) defineNatives() {
+	vm.defineNative("clock", 0, vm.clockNative)
+	vm.defineNative("now", 0, vm.nowNative)
+	vm.defineNative("format_time", 2, vm.formatTimeNative)
+	vm.defineNative("sleep", 1, vm.sleepNative)
+	vm.defineNative("eprint", 1, vm.eprintNative)
+	vm.defineNative("log", 2, vm.logNative)
+	vm.defineNative("write", 1, vm.writeNative)
+	vm.defineNative("read_line", 0, vm.readLineNative)
+	vm.defineNative("random", 0, vm.randomNative)
+	vm.defineNative("match", 2, vm.matchNative)
+	vm.defineNative("capture", 3, vm.captureNative)
+	vm.defineNative("replace", 3, vm.replaceNative)
+	vm.defineNative("len", 1, vm.lenNative)
+	vm.defineNative("byte_len", 1, vm.byteLenNative)
+	vm.defineNative("bytes", 1, vm.bytesNative)
+	vm.defineNative("byte_at", 2, vm.byteAtNative)
+	vm.defineNative("set_byte", 3, vm.setByteNative)
+	vm.defineNative("decode", 1, vm.decodeNative)
+	vm.defineNative("bit_count", 1, vm.bitCountNative)
+	vm.defineNative("bit_length", 1, vm.bitLengthNative)
+	vm.defineNative("sb_new", 0, vm.sbNewNative)
+	vm.defineNative("append", 2, vm.appendNative)
+	vm.defineNative("build", 1, vm.buildNative)
+	vm.defineNative("parse_int", 2, vm.parseIntNative)
+	vm.defineNative("to_base", 2, vm.toBaseNative)
+	vm.defineNative("shallow_equal", 2, vm.shallowEqualNative)
+	vm.defineNative("deep_equal", 2, vm.deepEqualNative)
+	vm.defineNative("assert_eq", 2, vm.assertEqNative)
+	vm.defineNative("assert_throws", 1, vm.assertThrowsNative)
+	vm.defineNative("callable", 1, vm.callableNative)
+	vm.defineNative("arity", 1, vm.arityNative)
+	if vm.allowEval {
+		vm.defineNative("eval", 1, vm.evalNative)
+	}
+}
+
+func (vm *Vm) defineNative(name string, arity int, function NativeFn) {
+	vm.globals.define(StringValue(name), &NativeValue{name, arity, function})
+}
+
+// clockNative returns the seconds elapsed since the Vm was created.
+func (vm *Vm) clockNative(args []Value) (Value, error) {
+	return NumberValue(vm.now().Sub(vm.startTime).Seconds()), nil
+}
+
+// nowNative returns the current time as seconds since the Unix epoch.
+func (vm *Vm) nowNative(args []Value) (Value, error) {
+	return NumberValue(float64(vm.now().UnixNano()) / 1e9), nil
+}
+
+// formatTimeNative formats a Unix timestamp in UTC using a Go time layout
+// such as "2006-01-02 15:04:05".
+func (vm *Vm) formatTimeNative(args []Value) (Value, error) {
+	if !isNumber(args[0].Type()) {
+		return nil, fmt.Errorf("format_time: timestamp must be a number.")
+	}
+	layout, ok := args[1].(StringValue)
+	if !ok {
+		return nil, fmt.Errorf("format_time: layout must be a string.")
+	}
+	seconds := toFloat(args[0])
+	timestamp := time.Unix(0, int64(seconds*1e9)).UTC()
+	return StringValue(timestamp.Format(string(layout))), nil
+}
+
+// sleepNative pauses the script for a number of seconds. It stops early
+// with an error if the Vm's context is done.
+func (vm *Vm) sleepNative(args []Value) (Value, error) {
+	if !isNumber(args[0].Type()) {
+		return nil, fmt.Errorf("sleep: duration must be a number.")
+	}
+	seconds := toFloat(args[0])
+	if !(seconds >= 0) {
+		return nil, fmt.Errorf("sleep: duration must not be negative.")
+	}
+	if err := vm.sleep(time.Duration(seconds * float64(time.Second))); err != nil {
+		return nil, fmt.Errorf("sleep: %v.", err)
+	}
+	return Nil, nil
+}
+
+// eprintNative prints a value like the print statement does, but to the
+// Vm's error output, so diagnostics stay out of a script's stdout.
+func (vm *Vm) eprintNative(args []Value) (Value, error) {
+	fmt.Fprintln(vm.errOut, vm.stringify(args[0]))
+	return Nil, nil
+}
+
+// logNative writes a message to the Vm's error output, prefixed with its
+// level, unless the level is below the Vm's log level.
+func (vm *Vm) logNative(args []Value) (Value, error) {
+	name, _ := args[0].(StringValue)
+	for level, levelName := range logLevelNames {
+		if string(name) != levelName {
+			continue
+		}
+		if LogLevel(level) >= vm.logLevel {
+			fmt.Fprintf(vm.errOut, "[%s] %s\n", levelName, vm.stringify(args[1]))
+		}
+		return Nil, nil
+	}
+	return nil, fmt.Errorf("log: level must be \"debug\", \"info\", \"warn\" or \"error\".")
+}
+
+// writeNative prints a value like the print statement does but without
+// the trailing newline. It writes straight to the output, bypassing any
+// OnPrint hook.
+func (vm *Vm) writeNative(args []Value) (Value, error) {
+	fmt.Fprint(vm.out, vm.stringify(args[0]))
+	return Nil, nil
+}
+
+// readLineNative reads a line from the Vm's input without its line
+// ending, or returns nil at the end of the input.
+func (vm *Vm) readLineNative(args []Value) (Value, error) {
+	line, err := vm.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return Nil, nil
+		}
+		return nil, fmt.Errorf("read_line: %v.", err)
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return StringValue(line), nil
+}
+
+// randomNative returns a pseudo-random number in [0, 1).
+func (vm *Vm) randomNative(args []Value) (Value, error) {
+	return NumberValue(vm.random.Float64()), nil
+}
+
+// matchNative reports whether text contains a match of pattern.
+func (vm *Vm) matchNative(args []Value) (Value, error) {
+	re, text, err := vm.regexArgs("match", args)
+	if err != nil {
+		return nil, err
+	}
+	return BoolValue(re.MatchString(text)), nil
+}
+
+// captureNative returns the given capture group of the first match of
+// pattern in text, with group 0 being the whole match, or nil if there is
+// no match.
+func (vm *Vm) captureNative(args []Value) (Value, error) {
+	re, text, err := vm.regexArgs("capture", args)
+	if err != nil {
+		return nil, err
+	}
+	group, ok := integerArg(args[2])
+	if !ok || group < 0 || group > int64(re.NumSubexp()) {
+		return nil, fmt.Errorf("capture: group must be an integer between 0 and %d.", re.NumSubexp())
+	}
+	match := re.FindStringSubmatch(text)
+	if match == nil {
+		return Nil, nil
+	}
+	return StringValue(match[int(group)]), nil
+}
+
+// replaceNative replaces every match of pattern in text with repl, which
+// may refer to capture groups as $1 or ${name}.
+func (vm *Vm) replaceNative(args []Value) (Value, error) {
+	re, text, err := vm.regexArgs("replace", args)
+	if err != nil {
+		return nil, err
+	}
+	repl, ok := args[2].(StringValue)
+	if !ok {
+		return nil, fmt.Errorf("replace: replacement must be a string.")
+	}
+	return StringValue(re.ReplaceAllString(text, string(repl))), nil
+}
+
+// regexArgs checks the pattern and text arguments shared by the regex
+// natives and compiles the pattern, reusing earlier compilations.
+func (vm *Vm) regexArgs(name string, args []Value) (*regexp.Regexp, string, error) {
+	pattern, isPatternString := args[0].(StringValue)
+	text, isTextString := args[1].(StringValue)
+	if !isPatternString || !isTextString {
+		return nil, "", fmt.Errorf("%s: pattern and text must be strings.", name)
+	}
+	if re, ok := vm.regexps[string(pattern)]; ok {
+		return re, string(text), nil
+	}
+	re, err := regexp.Compile(string(pattern))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: invalid pattern: %s", name, err)
+	}
+	vm.regexps[string(pattern)] = re
+	return re, string(text), nil
+}
+
+// lenNative returns the length of a string in runes (Unicode code points),
+// so len("é") is 1, or the length of a bytes value in bytes.
+func (vm *Vm) lenNative(args []Value) (Value, error) {
+	switch value := args[0].(type) {
+	case StringValue:
+		return IntValue(utf8.RuneCountInString(string(value))), nil
+	case *BytesValue:
+		return IntValue(len(value.data)), nil
+	}
+	return nil, fmt.Errorf("len: argument must be a string or bytes.")
+}
+
+// byteLenNative returns the length of a string's UTF-8 encoding in bytes.
+func (vm *Vm) byteLenNative(args []Value) (Value, error) {
+	text, ok := args[0].(StringValue)
+	if !ok {
+		return nil, fmt.Errorf("byte_len: argument must be a string.")
+	}
+	return IntValue(len(text)), nil
+}
+
+// sbNewNative returns an empty string builder.
+func (vm *Vm) sbNewNative(args []Value) (Value, error) {
+	return &StringBuilderValue{}, nil
+}
+
+// appendNative adds a value to a string builder, formatted as print would
+// show it, and returns the builder so calls can be chained.
+func (vm *Vm) appendNative(args []Value) (Value, error) {
+	builder, ok := args[0].(*StringBuilderValue)
+	if !ok {
+		return nil, fmt.Errorf("append: first argument must be a string builder.")
+	}
+	builder.builder.WriteString(vm.stringify(args[1]))
+	return builder, nil
+}
+
+// buildNative returns the string accumulated so far. The builder can keep
+// being appended to afterwards.
+func (vm *Vm) buildNative(args []Value) (Value, error) {
+	builder, ok := args[0].(*StringBuilderValue)
+	if !ok {
+		return nil, fmt.Errorf("build: argument must be a string builder.")
+	}
+	return StringValue(builder.builder.String()), nil
+}
+
+// bitCountNative returns the number of one bits in the magnitude of an
+// integer, so bit_count(-5) is bit_count(5).
+func (vm *Vm) bitCountNative(args []Value) (Value, error) {
+	magnitude, err := integerMagnitude("bit_count", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(bits.OnesCount64(magnitude)), nil
+}
+
+// bitLengthNative returns the number of bits needed to represent the
+// magnitude of an integer, with bit_length(0) being 0.
+func (vm *Vm) bitLengthNative(args []Value) (Value, error) {
+	magnitude, err := integerMagnitude("bit_length", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(bits.Len64(magnitude)), nil
+}
+
+// parseIntNative parses a string of digits in the given base, with an
+// optional sign.
+func (vm *Vm) parseIntNative(args []Value) (Value, error) {
+	text, ok := args[0].(StringValue)
+	if !ok {
+		return nil, fmt.Errorf("parse_int: first argument must be a string.")
+	}
+	base, err := baseArg("parse_int", args[1])
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(string(text), base, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("parse_int: '%s' is out of range.", text)
+		}
+		return nil, fmt.Errorf("parse_int: '%s' is not a base %d integer.", text, base)
+	}
+	return IntValue(n), nil
+}
+
+// toBaseNative formats an integer in the given base, using lowercase
+// letters for digits above 9.
+func (vm *Vm) toBaseNative(args []Value) (Value, error) {
+	magnitude, err := integerMagnitude("to_base", args[0])
+	if err != nil {
+		return nil, err
+	}
+	base, err := baseArg("to_base", args[1])
+	if err != nil {
+		return nil, err
+	}
+	text := strconv.FormatUint(magnitude, base)
+	if n, _ := integerArg(args[0]); n < 0 {
+		text = "-" + text
+	}
+	return StringValue(text), nil
+}
+
+// shallowEqualNative compares like '==': instances and bytes are only
+// equal to themselves.
+func (vm *Vm) shallowEqualNative(args []Value) (Value, error) {
+	return BoolValue(valuesEqual(args[0], args[1])), nil
+}
+
+// deepEqualNative compares instances of the same class field by field and
+// bytes by content.
+func (vm *Vm) deepEqualNative(args []Value) (Value, error) {
+	return BoolValue(deepEqual(args[0], args[1], map[[2]Value]bool{})), nil
+}
+
+// assertEqNative raises a runtime error showing both values unless they
+// are deep_equal.
+func (vm *Vm) assertEqNative(args []Value) (Value, error) {
+	if !deepEqual(args[0], args[1], map[[2]Value]bool{}) {
+		return nil, fmt.Errorf("assert_eq: expected %s but got %s.", vm.stringify(args[1]), vm.stringify(args[0]))
+	}
+	return Nil, nil
+}
+
+// assertThrowsNative calls a function with no arguments and raises a
+// runtime error unless the call does.
+func (vm *Vm) assertThrowsNative(args []Value) (Value, error) {
+	if !isCallable(args[0]) {
+		return nil, fmt.Errorf("assert_throws: argument must be callable.")
+	}
+	if _, err := vm.callNested(args[0]); err == nil {
+		return nil, fmt.Errorf("assert_throws: call did not raise an error.")
+	}
+	return Nil, nil
+}
+
+// callableNative reports whether a value can be called.
+func (vm *Vm) callableNative(args []Value) (Value, error) {
+	return BoolValue(isCallable(args[0])), nil
+}
+
+// arityNative returns how many arguments a callable takes. A class takes
+// the arguments of its initializer.
+func (vm *Vm) arityNative(args []Value) (Value, error) {
+	switch callee := args[0].(type) {
+	case *ClosureValue:
+		return IntValue(callee.function.arity), nil
+	case *BoundMethodValue:
+		return IntValue(callee.method.function.arity), nil
+	case *NativeValue:
+		return IntValue(callee.arity), nil
+	case *ClassValue:
+		if initializer, ok := callee.methods["init"]; ok {
+			return IntValue(initializer.function.arity), nil
+		}
+		return IntValue(0), nil
+	}
+	return nil, fmt.Errorf("arity: %s is not callable.", args[0].Type())
+}
+
+// evalNative compiles source and runs it with the Vm's globals. It
+// returns the value of a top-level return statement in source, or nil.
+// Compile errors are raised as a runtime error carrying the first one.
+func (vm *Vm) evalNative(args []Value) (Value, error) {
+	source, ok := args[0].(StringValue)
+	if !ok {
+		return nil, fmt.Errorf("eval: argument must be a string.")
+	}
+	compiler := vm.newCompiler(string(source))
+	compiler.functionType = FunctionTypeEval
+	compiler.errOut = io.Discard
+	function, ok := compiler.compile()
+	if !ok {
+		return nil, fmt.Errorf("eval: %s", compiler.errors[0])
+	}
+	return vm.callNested(NewClosureValue(function))
+}
+
+// baseArg checks that a number is an integer base from 2 to 36.
+func baseArg(name string, value Value) (int, error) {
+	base, ok := integerArg(value)
+	if !ok || base < 2 || base > 36 {
+		return 0, fmt.Errorf("%s: base must be an integer between 2 and 36.", name)
+	}
+	return int(base), nil
+}
+
+// integerArg accepts an integer, or a float that holds an int64 exactly.
+// Fractions, infinities and NaN are rejected.
+func integerArg(value Value) (int64, bool) {
+	switch value := value.(type) {
+	case IntValue:
+		return int64(value), true
+	case NumberValue:
+		n := float64(value)
+		if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// integerMagnitude returns the absolute value of an integer argument.
+func integerMagnitude(name string, value Value) (uint64, error) {
+	n, ok := integerArg(value)
+	if !ok {
+		return 0, fmt.Errorf("%s: argument must be an integer.", name)
+	}
+	if n < 0 {
+		return uint64(-n), nil
+	}
+	return uint64(n), nil
+}
+
+// bytesNative returns the UTF-8 encoding of a string, or the given number
+// of zero bytes.
+func (vm *Vm) bytesNative(args []Value) (Value, error) {
+	switch value := args[0].(type) {
+	case StringValue:
+		return &BytesValue{data: []byte(value)}, nil
+	case NumberValue, IntValue:
+		n, ok := integerArg(value)
+		if !ok || n < 0 || n > math.MaxInt32 {
+			return nil, fmt.Errorf("bytes: length must be a non-negative integer.")
+		}
+		return &BytesValue{data: make([]byte, n)}, nil
+	}
+	return nil, fmt.Errorf("bytes: argument must be a string or a length.")
+}
+
+// byteAtNative returns the byte at an index as a number from 0 to 255.
+func (vm *Vm) byteAtNative(args []Value) (Value, error) {
+	bytes, index, err := bytesIndex("byte_at", args)
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(bytes.data[index]), nil
+}
+
+// setByteNative overwrites the byte at an index in place and returns the
+// new value.
+func (vm *Vm) setByteNative(args []Value) (Value, error) {
+	bytes, index, err := bytesIndex("set_byte", args)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := integerArg(args[2])
+	if !ok || value < 0 || value > math.MaxUint8 {
+		return nil, fmt.Errorf("set_byte: value must be an integer between 0 and 255.")
+	}
+	bytes.data[index] = byte(value)
+	return IntValue(value), nil
+}
+
+// decodeNative converts bytes holding valid UTF-8 to a string.
+func (vm *Vm) decodeNative(args []Value) (Value, error) {
+	bytes, ok := args[0].(*BytesValue)
+	if !ok {
+		return nil, fmt.Errorf("decode: argument must be bytes.")
+	}
+	if !utf8.Valid(bytes.data) {
+		return nil, fmt.Errorf("decode: bytes are not valid UTF-8.")
+	}
+	return StringValue(bytes.data), nil
+}
+
+// bytesIndex checks the bytes and index arguments shared by byte_at and
+// set_byte.
+func bytesIndex(name string, args []Value) (*BytesValue, int, error) {
+	bytes, ok := args[0].(*BytesValue)
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: first argument must be bytes.", name)
+	}
+	index, ok := integerArg(args[1])
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: index must be an integer.", name)
+	}
+	if index < 0 || index >= int64(len(bytes.data)) {
+		return nil, 0, fmt.Errorf("%s: index %d is out of range for %d bytes.", name, index, len(bytes.data))
+	}
+	return bytes, int(index), nil
+}
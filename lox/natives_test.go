@@ -0,0 +1,482 @@
+package lox
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegexNatives(t *testing.T) {
+	globals := globalsAfter(t, `
+		var found = match("a+b", "caaab");
+		var missing = match("^b", "abc");
+		var domain = capture("(\w+)@(\w+)", "mail bob@example now", 2);
+		var whole = capture("(\w+)@(\w+)", "mail bob@example now", 0);
+		var none = capture("(\d+)", "no digits", 1);
+		var replaced = replace("(\w+)@(\w+)", "bob@example, amy@test", "$2:$1");
+		var unchanged = replace("z", "abc", "y");
+	`)
+	want := map[StringValue]Value{
+		"found": BoolValue(true), "missing": BoolValue(false), "domain": StringValue("example"),
+		"whole": StringValue("bob@example"), "none": Nil, "replaced": StringValue("example:bob, test:amy"),
+		"unchanged": StringValue("abc"),
+	}
+	for name, value := range want {
+		if globals[name] != value {
+			t.Errorf("%s = %v, want %v", name, globals[name], value)
+		}
+	}
+}
+
+func TestRegexNativeErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`match("(", "x");`, "match: invalid pattern: error parsing regexp: missing closing ): `(`"},
+		{`replace("[a-", "x", "y");`, "replace: invalid pattern: error parsing regexp: missing closing ]: `[a-`"},
+		{`capture("a", 1, 0);`, "capture: pattern and text must be strings."},
+		{`capture("(a)", "a", 2);`, "capture: group must be an integer between 0 and 1."},
+		{`replace("a", "a", nil);`, "replace: replacement must be a string."},
+	}
+	for _, test := range tests {
+		expectRuntimeError(t, test.source, test.want)
+	}
+}
+
+func TestStringLengthCountsRunes(t *testing.T) {
+	globals := globalsAfter(t, `
+		var ascii = len("abc");
+		var accented = len("héllo");
+		var accentedBytes = byte_len("héllo");
+		var emoji = len("🙂!");
+		var emojiBytes = byte_len("🙂!");
+		var empty = len("") + byte_len("");
+	`)
+	want := map[StringValue]Value{"ascii": IntValue(3), "accented": IntValue(5), "accentedBytes": IntValue(6),
+		"emoji": IntValue(2), "emojiBytes": IntValue(5), "empty": IntValue(0)}
+	for name, value := range want {
+		if globals[name] != value {
+			t.Errorf("%s = %v, want %v", name, globals[name], value)
+		}
+	}
+
+	expectRuntimeError(t, "len(1);", "len: argument must be a string or bytes.")
+	expectRuntimeError(t, "byte_len(nil);", "byte_len: argument must be a string.")
+}
+
+func TestBitNatives(t *testing.T) {
+	globals := globalsAfter(t, `
+		var countZero = bit_count(0);
+		var countSeven = bit_count(7);
+		var countNegative = bit_count(-5);
+		var countPower = bit_count(1024);
+		var lengthZero = bit_length(0);
+		var lengthOne = bit_length(1);
+		var lengthPower = bit_length(1024);
+		var lengthNegative = bit_length(-255);
+	`)
+	want := map[StringValue]Value{"countZero": IntValue(0), "countSeven": IntValue(3),
+		"countNegative": IntValue(2), "countPower": IntValue(1), "lengthZero": IntValue(0),
+		"lengthOne": IntValue(1), "lengthPower": IntValue(11), "lengthNegative": IntValue(8)}
+	for name, value := range want {
+		if globals[name] != value {
+			t.Errorf("%s = %v, want %v", name, globals[name], value)
+		}
+	}
+
+	expectRuntimeError(t, "bit_count(1.5);", "bit_count: argument must be an integer.")
+	expectRuntimeError(t, `bit_length("1");`, "bit_length: argument must be an integer.")
+	expectRuntimeError(t, "bit_count(1/0);", "bit_count: argument must be an integer.")
+	expectRuntimeError(t, "bit_length(2 ** 70);", "bit_length: argument must be an integer.")
+}
+
+func TestStringBuilder(t *testing.T) {
+	globals := globalsAfter(t, `
+		var sb = sb_new();
+		var empty = build(sb);
+		append(append(sb, "n="), 42);
+		append(sb, nil);
+		var first = build(sb);
+		append(sb, true);
+		var second = build(sb);
+		var loop = sb_new();
+		for (var i = 0; i < 3; i = i + 1) append(loop, i);
+		var digits = build(loop);
+	`)
+	want := map[StringValue]Value{"empty": StringValue(""), "first": StringValue("n=42nil"),
+		"second": StringValue("n=42niltrue"), "digits": StringValue("012")}
+	for name, value := range want {
+		if globals[name] != value {
+			t.Errorf("%s = %v, want %v", name, globals[name], value)
+		}
+	}
+
+	expectRuntimeError(t, `append("a", "b");`, "append: first argument must be a string builder.")
+	expectRuntimeError(t, `build("a");`, "build: argument must be a string builder.")
+}
+
+func TestDeterministicRunsRepeat(t *testing.T) {
+	source := `
+		for (var i = 0; i < 3; i = i + 1) {
+			print random();
+			print clock();
+		}
+	`
+	run := func(seed int64) string {
+		vm, out, _ := newTestVm()
+		vm.Deterministic(seed)
+		if result := vm.Interpret(source); result != InterpretOk {
+			t.Errorf("Interpret = %d", result)
+		}
+		return out.String()
+	}
+	first, second := run(42), run(42)
+	if first != second {
+		t.Errorf("two runs with seed 42 differ:\n%s\n%s", first, second)
+	}
+	if other := run(7); other == first {
+		t.Errorf("seeds 42 and 7 printed the same output:\n%s", first)
+	}
+	// The fake clock advances one millisecond per reading.
+	lines := strings.Split(first, "\n")
+	if lines[1] != "0.001" || lines[3] != "0.002" || lines[5] != "0.003" {
+		t.Errorf("clock() readings = %q, %q, %q", lines[1], lines[3], lines[5])
+	}
+}
+
+func TestBytes(t *testing.T) {
+	expectOutput(t, `
+		var b = bytes("héllo");
+		print len(b);
+		print byte_at(b, 1);
+		print set_byte(b, 0, 72);
+		print decode(b);
+		var zeros = bytes(3);
+		print zeros;
+		set_byte(zeros, 2, 255);
+		print byte_at(zeros, 2);
+	`, "6\n195\n72\nHéllo\nb\"\\x00\\x00\\x00\"\n255\n")
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`var b = bytes("a"); set_byte(b, 0, 200); decode(b);`, "decode: bytes are not valid UTF-8."},
+		{`byte_at(bytes(2), 2);`, "byte_at: index 2 is out of range for 2 bytes."},
+		{`set_byte(bytes(2), -1, 0);`, "set_byte: index -1 is out of range for 2 bytes."},
+		{`set_byte(bytes(1), 0, 256);`, "set_byte: value must be an integer between 0 and 255."},
+		{`byte_at(bytes(1), 0.5);`, "byte_at: index must be an integer."},
+		{`byte_at("a", 0);`, "byte_at: first argument must be bytes."},
+		{`bytes(-1);`, "bytes: length must be a non-negative integer."},
+		{`bytes(nil);`, "bytes: argument must be a string or a length."},
+		{`decode("a");`, "decode: argument must be bytes."},
+	}
+	for _, test := range tests {
+		expectRuntimeError(t, test.source, test.want)
+	}
+}
+
+func TestEprintWritesToErrorOutput(t *testing.T) {
+	vm, out, errOut := newTestVm()
+	if result := vm.Interpret(`print "out"; eprint("err"); eprint(1 + 2); print "done";`); result != InterpretOk {
+		t.Fatalf("Interpret = %d", result)
+	}
+	if out.String() != "out\ndone\n" {
+		t.Errorf("output = %q, want %q", out, "out\ndone\n")
+	}
+	if errOut.String() != "err\n3\n" {
+		t.Errorf("error output = %q, want %q", errOut.String(), "err\n3\n")
+	}
+}
+
+func TestParseIntAndToBase(t *testing.T) {
+	expectOutput(t, `
+		print parse_int("ff", 16);
+		print parse_int("-101", 2);
+		print parse_int("+z", 36);
+		print to_base(255, 16);
+		print to_base(-5, 2);
+		print to_base(0, 7);
+		print parse_int(to_base(123456, 36), 36);
+	`, "255\n-5\n35\nff\n-101\n0\n123456\n")
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`parse_int("12", 2);`, "parse_int: '12' is not a base 2 integer."},
+		{`parse_int("", 10);`, "parse_int: '' is not a base 10 integer."},
+		{`parse_int("99999999999999999999", 10);`, "parse_int: '99999999999999999999' is out of range."},
+		{`parse_int(12, 10);`, "parse_int: first argument must be a string."},
+		{`parse_int("1", 1);`, "parse_int: base must be an integer between 2 and 36."},
+		{`to_base(10, 37);`, "to_base: base must be an integer between 2 and 36."},
+		{`to_base(1.5, 2);`, "to_base: argument must be an integer."},
+	}
+	for _, test := range tests {
+		expectRuntimeError(t, test.source, test.want)
+	}
+}
+
+func TestEqualityNatives(t *testing.T) {
+	expectOutput(t, `
+		class Point { init(x, y) { this.x = x; this.y = y; } }
+		class Other { init(x, y) { this.x = x; this.y = y; } }
+		var a = Point(1, Point(2, 3));
+		var b = Point(1, Point(2, 3));
+		print shallow_equal(a, b);
+		print deep_equal(a, b);
+		print shallow_equal(a, a);
+		b.y.y = 4;
+		print deep_equal(a, b);
+		print deep_equal(Point(1, 2), Other(1, 2));
+		var extra = Point(1, 2);
+		extra.z = 3;
+		print deep_equal(Point(1, 2), extra);
+		print deep_equal(bytes("ab"), bytes("ab"));
+		print shallow_equal(bytes("ab"), bytes("ab"));
+		print deep_equal(1, 1) and deep_equal("s", "s") and !deep_equal(1, "1");
+	`, "false\ntrue\ntrue\nfalse\nfalse\nfalse\ntrue\nfalse\ntrue\n")
+
+	// Cyclic instances terminate.
+	expectOutput(t, `
+		class Node {}
+		var a = Node(); var b = Node();
+		a.next = a; b.next = b;
+		print deep_equal(a, b);
+		a.value = 1; b.value = 2;
+		print deep_equal(a, b);
+	`, "true\nfalse\n")
+}
+
+func TestWriteOmitsTheNewline(t *testing.T) {
+	expectOutput(t, `write("a"); write("b");`, "ab")
+	expectOutput(t, `write(1); write(2.5); print "";`, "12.5\n")
+
+	// write bypasses the OnPrint hook.
+	vm, out, _ := newTestVm()
+	vm.OnPrint(func(Value) bool { return true })
+	vm.Interpret(`write("a"); print "b"; write("c");`)
+	if out.String() != "ac" {
+		t.Errorf("printed %q, want %q", out, "ac")
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"lines", "one\ntwo\n", "one\ntwo\nnil\n"},
+		{"no final newline", "one\ntwo", "one\ntwo\nnil\n"},
+		{"crlf", "one\r\ntwo\r\n", "one\ntwo\nnil\n"},
+		{"blank line", "\nend\n", "\nend\nnil\n"},
+		{"empty input", "", "nil\nnil\nnil\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm, out, errOut := newTestVm(WithInput(strings.NewReader(test.input)))
+			source := "print read_line(); print read_line(); print read_line();"
+			if result := vm.Interpret(source); result != InterpretOk {
+				t.Fatalf("Interpret = %d; errors:\n%s", result, errOut)
+			}
+			if out.String() != test.want {
+				t.Errorf("printed %q, want %q", out, test.want)
+			}
+		})
+	}
+}
+
+func TestReadLineKeepsItsPlaceAcrossRuns(t *testing.T) {
+	vm, out, _ := newTestVm(WithInput(strings.NewReader("first\nsecond\n")))
+	vm.Interpret("print read_line();")
+	vm.Interpret("print read_line() == nil; print read_line() == nil;")
+	if out.String() != "first\nfalse\ntrue\n" {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestAssertEq(t *testing.T) {
+	expectOutput(t, `
+		class Point { init(x, y) { this.x = x; this.y = y; } }
+		assert_eq(1 + 1, 2);
+		assert_eq("a" + "b", "ab");
+		assert_eq(Point(1, 2), Point(1, 2));
+		print "passed";
+	`, "passed\n")
+	expectRuntimeError(t, `assert_eq(1 + 1, 3);`, "assert_eq: expected 3 but got 2.")
+	expectRuntimeError(t, `assert_eq("a", nil);`, "assert_eq: expected nil but got a.")
+}
+
+func TestAssertThrows(t *testing.T) {
+	vm, out, errOut := newTestVm()
+	vm.SetDivision(DivisionChecked)
+	source := `
+		fun divide() { return 1 / 0; }
+		fun deep(n) { if (n == 0) return 1 / 0; return deep(n - 1); }
+		fun check() {
+			var local = "kept";
+			assert_throws(divide);
+			assert_throws(fun_deep);
+			return local;
+		}
+		fun fun_deep() { return deep(5); }
+		print check();
+		assert_throws(len);
+	`
+	if result := vm.Interpret(source); result != InterpretOk {
+		t.Fatalf("Interpret = %d; errors:\n%s", result, errOut)
+	}
+	// The errors unwind back to the native without being reported,
+	// leaving the caller's frames and locals intact.
+	if out.String() != "kept\n" || errOut.Len() != 0 {
+		t.Errorf("printed %q and reported %q", out, errOut)
+	}
+	if vm.stackTop != 0 || len(vm.frames) != 0 {
+		t.Errorf("left %d frames and %d values behind", len(vm.frames), vm.stackTop)
+	}
+
+	expectRuntimeError(t, "fun ok() { return 1; } assert_throws(ok);", "assert_throws: call did not raise an error.")
+	expectRuntimeError(t, "assert_throws(1);", "assert_throws: argument must be callable.")
+}
+
+func TestEval(t *testing.T) {
+	vm, out, errOut := newTestVm(WithEval())
+	source := `
+		eval("fun square(n) { return n * n; } var nine = square(3);");
+		print nine;
+		print square(4);
+		print eval("return square(5) + 1;");
+		print eval("var unused = 1;");
+		fun run(code) { var local = "kept"; eval(code); return local; }
+		print run("print 1;");
+	`
+	if result := vm.Interpret(source); result != InterpretOk {
+		t.Fatalf("Interpret = %d; errors:\n%s", result, errOut)
+	}
+	if want := "9\n16\n26\nnil\n1\nkept\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+
+	expectEvalError := func(source, want string) {
+		t.Helper()
+		vm, _, _ := newTestVm(WithEval())
+		vm.Interpret(source)
+		if errors := vm.Errors(); len(errors) != 1 || errors[0] != want {
+			t.Errorf("%s reported %q, want %q", source, errors, want)
+		}
+	}
+	expectEvalError(`eval("print 1 +;");`, "eval: [line 1, col 10] Error at ';': Expect expression.")
+	expectEvalError(`eval("print nil + 1;");`, "Operands must be two numbers or two strings.")
+	expectEvalError(`eval(1);`, "eval: argument must be a string.")
+
+	// Without WithEval there is no eval.
+	expectRuntimeError(t, `eval("print 1;");`, "Undefined variable 'eval'.")
+}
+
+func TestCallableAndArity(t *testing.T) {
+	expectOutput(t, `
+		fun none() {}
+		fun pair(a, b) {}
+		class Plain {}
+		class Point {
+			init(x, y) {}
+			scale(factor) {}
+		}
+		var point = Point(1, 2);
+		print callable(none) and callable(pair) and callable(len) and callable(Plain) and callable(point.scale);
+		print callable(point) or callable(1) or callable("len") or callable(nil);
+		print arity(none);
+		print arity(pair);
+		print arity(len);
+		print arity(clock);
+		print arity(Plain);
+		print arity(Point);
+		print arity(point.scale);
+	`, "true\nfalse\n0\n2\n1\n0\n0\n2\n1\n")
+	expectRuntimeError(t, "arity(1);", "arity: int is not callable.")
+	expectRuntimeError(t, "class A {} arity(A());", "arity: instance is not callable.")
+}
+
+func TestLog(t *testing.T) {
+	const source = `log("debug", "d"); log("info", 1 + 1); log("warn", "w"); log("error", nil);`
+	tests := []struct {
+		level LogLevel
+		want  string
+	}{
+		{LogDebug, "[debug] d\n[info] 2\n[warn] w\n[error] nil\n"},
+		{LogInfo, "[info] 2\n[warn] w\n[error] nil\n"},
+		{LogWarn, "[warn] w\n[error] nil\n"},
+		{LogError, "[error] nil\n"},
+	}
+	for _, test := range tests {
+		vm, out, errOut := newTestVm()
+		vm.SetLogLevel(test.level)
+		if result := vm.Interpret(source); result != InterpretOk {
+			t.Fatalf("Interpret = %d; errors:\n%s", result, errOut)
+		}
+		if errOut.String() != test.want || out.Len() != 0 {
+			t.Errorf("level %d logged %q and printed %q, want %q", test.level, errOut, out, test.want)
+		}
+	}
+
+	// The default drops debug messages.
+	vm, _, errOut := newTestVm()
+	vm.Interpret(`log("debug", "hidden"); log("info", "shown");`)
+	if errOut.String() != "[info] shown\n" {
+		t.Errorf("by default, logged %q", errOut)
+	}
+
+	expectRuntimeError(t, `log("verbose", "x");`, `log: level must be "debug", "info", "warn" or "error".`)
+}
+
+func TestTimeNatives(t *testing.T) {
+	vm, out, errOut := newTestVm()
+	vm.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 5e8, time.UTC) }
+	source := `
+		var ts = now();
+		print ts == 1704164645.5;
+		print format_time(ts, "2006-01-02 15:04:05.000");
+		print format_time(0, "Jan 2 2006");
+	`
+	if result := vm.Interpret(source); result != InterpretOk {
+		t.Fatalf("Interpret = %d; errors:\n%s", result, errOut)
+	}
+	if want := "true\n2024-01-02 03:04:05.500\nJan 1 1970\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+
+	expectRuntimeError(t, `format_time("now", "2006");`, "format_time: timestamp must be a number.")
+	expectRuntimeError(t, "sleep(-1);", "sleep: duration must not be negative.")
+}
+
+func TestSleep(t *testing.T) {
+	// A deterministic Vm advances its fake clock instead of waiting.
+	vm, out, _ := newTestVm()
+	vm.Deterministic(1)
+	vm.Interpret("var start = clock(); sleep(2.5); print clock() - start > 2.5;")
+	if out.String() != "true\n" {
+		t.Errorf("printed %q", out)
+	}
+
+	expectOutput(t, "sleep(0.001); print 1;", "1\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vm, _, _ = newTestVm(WithContext(ctx))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if result := vm.Interpret("sleep(60);"); result != InterpretRuntimeError {
+		t.Errorf("Interpret = %d, want InterpretRuntimeError", result)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled sleep took %v", elapsed)
+	}
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != "sleep: context canceled." {
+		t.Errorf("Errors() = %q", errors)
+	}
+}
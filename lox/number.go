@@ -0,0 +1,160 @@
+package lox
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Lox has two kinds of number. Literals without a '.' are integers
+// (IntValue) and everything else is a float (NumberValue). Arithmetic on
+// two integers stays integral as long as the result is a whole number
+// that fits in an int64; otherwise, and whenever a float is involved, it
+// is done in floating point.
+
+// parseNumber converts a number literal. Integer literals too large for
+// an int64 become floats.
+func parseNumber(lexeme string) Value {
+	if !strings.Contains(lexeme, ".") {
+		if n, err := strconv.ParseInt(lexeme, 10, 64); err == nil {
+			return IntValue(n)
+		}
+	}
+	value, _ := strconv.ParseFloat(lexeme, 64)
+	return NumberValue(value)
+}
+
+func isNumber(valueType ValueType) bool {
+	return valueType == TypeNumber || valueType == TypeInt
+}
+
+// toFloat returns the value of a number as a float64.
+func toFloat(value Value) float64 {
+	if n, ok := value.(IntValue); ok {
+		return float64(n)
+	}
+	return float64(value.(NumberValue))
+}
+
+// negate implements unary '-'. Negating the smallest int64 overflows, so
+// it gives a float.
+func negate(value Value) Value {
+	if n, ok := value.(IntValue); ok && n != math.MinInt64 {
+		return -n
+	}
+	return NumberValue(-toFloat(value))
+}
+
+// arithmetic applies OP_ADD, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE,
+// OP_MODULO or OP_EXPONENT to two numbers.
+func arithmetic(op OpCode, a, b Value) Value {
+	x, isXInt := a.(IntValue)
+	y, isYInt := b.(IntValue)
+	if isXInt && isYInt {
+		if result, ok := intArithmetic(op, int64(x), int64(y)); ok {
+			return IntValue(result)
+		}
+	}
+	x2, y2 := toFloat(a), toFloat(b)
+	switch op {
+	case OpAdd:
+		return NumberValue(x2 + y2)
+	case OpSubtract:
+		return NumberValue(x2 - y2)
+	case OpMultiply:
+		return NumberValue(x2 * y2)
+	case OpDivide:
+		return NumberValue(x2 / y2)
+	case OpModulo:
+		return NumberValue(math.Mod(x2, y2))
+	default:
+		return NumberValue(math.Pow(x2, y2))
+	}
+}
+
+// intArithmetic reports false when the result isn't a whole number that
+// fits in an int64: on overflow, a division with a remainder, a zero
+// divisor or a negative exponent.
+func intArithmetic(op OpCode, x, y int64) (int64, bool) {
+	switch op {
+	case OpAdd:
+		sum := x + y
+		return sum, (sum > x) == (y > 0)
+	case OpSubtract:
+		difference := x - y
+		return difference, (difference < x) == (y > 0)
+	case OpMultiply:
+		return multiplyInts(x, y)
+	case OpDivide:
+		if y == 0 || x%y != 0 || (x == math.MinInt64 && y == -1) {
+			return 0, false
+		}
+		return x / y, true
+	case OpModulo:
+		if y == 0 {
+			return 0, false
+		}
+		return x % y, true
+	default:
+		if y < 0 {
+			return 0, false
+		}
+		// Exponentiation by squaring.
+		result, base, ok := int64(1), x, true
+		for y > 0 {
+			if y&1 == 1 {
+				if result, ok = multiplyInts(result, base); !ok {
+					return 0, false
+				}
+			}
+			y >>= 1
+			if y > 0 {
+				if base, ok = multiplyInts(base, base); !ok {
+					return 0, false
+				}
+			}
+		}
+		return result, true
+	}
+}
+
+func multiplyInts(x, y int64) (int64, bool) {
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	product := x * y
+	if product/y != x || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+		return 0, false
+	}
+	return product, true
+}
+
+// compareNumbers applies OP_GREATER, OP_LESS, OP_GREATER_EQUAL or
+// OP_LESS_EQUAL to two numbers.
+func compareNumbers(op OpCode, a, b Value) bool {
+	x, isXInt := a.(IntValue)
+	y, isYInt := b.(IntValue)
+	if isXInt && isYInt {
+		switch op {
+		case OpGreater:
+			return x > y
+		case OpLess:
+			return x < y
+		case OpGreaterEqual:
+			return x >= y
+		default:
+			return x <= y
+		}
+	}
+	x2, y2 := toFloat(a), toFloat(b)
+	switch op {
+	case OpGreater:
+		return x2 > y2
+	case OpLess:
+		return x2 < y2
+	case OpGreaterEqual:
+		return x2 >= y2
+	default:
+		return x2 <= y2
+	}
+}
@@ -0,0 +1,100 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestDivisionByZero(t *testing.T) {
+	const source = `
+		print 1 / 0;
+		print -1 / 0;
+		print 0 / 0;
+		print 1 % 0;
+		print 1.5 / 0;
+		print 0 / 0 == 0 / 0;
+	`
+	expectOutput(t, source, "+Inf\n-Inf\nNaN\nNaN\n+Inf\nfalse\n")
+
+	for _, source := range []string{"print 1 / 0;", "print 0 / 0;", "print 1 % 0;", "print 1.5 / 0.0;", "var zero = 0; print 1 / zero;"} {
+		vm, out, _ := newTestVm()
+		vm.SetDivision(DivisionChecked)
+		if result := vm.Interpret(source); result != InterpretRuntimeError {
+			t.Errorf("checked %q = %d, want InterpretRuntimeError", source, result)
+		}
+		if errors := vm.Errors(); len(errors) != 1 || errors[0] != "Division by zero." {
+			t.Errorf("checked %q reported %q", source, errors)
+		}
+		if out.Len() != 0 {
+			t.Errorf("checked %q printed %q", source, out)
+		}
+	}
+}
+
+func TestDivisionOfNonZeroDivisors(t *testing.T) {
+	for _, division := range []Division{DivisionIEEE, DivisionChecked} {
+		vm, out, _ := newTestVm()
+		vm.SetDivision(division)
+		vm.Interpret("print 7 / 2; print 6 / 2; print -7 / 2; print 7 % 3; print 7.5 % 2;")
+		if want := "3.5\n3\n-3.5\n1\n1.5\n"; out.String() != want {
+			t.Errorf("division mode %d printed %q, want %q", division, out, want)
+		}
+	}
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []struct {
+		a, op, b string
+		want     Value
+	}{
+		{"7", "%", "3", IntValue(1)},
+		{"-7", "%", "3", IntValue(-1)},
+		{"6", "/", "2", IntValue(3)},
+		{"6", "/", "4", NumberValue(1.5)},
+		{"-7", "/", "2", NumberValue(-3.5)},
+		{"2", "**", "10", IntValue(1024)},
+		{"2", "**", "-1", NumberValue(0.5)},
+		{"1000", "*", "1000", IntValue(1000000)},
+		// Mixing in a float gives a float, even when it is whole.
+		{"1", "+", "0.5", NumberValue(1.5)},
+		{"2", "*", "1.5", NumberValue(3)},
+		{"3.0", "-", "1", NumberValue(2)},
+		{"7.5", "%", "2", NumberValue(1.5)},
+		// Results that don't fit in an int64 fall back to floats.
+		{"9223372036854775807", "+", "1", NumberValue(9223372036854775808)},
+		{"-9223372036854775807", "-", "2", NumberValue(-9223372036854775809)},
+		{"3037000500", "*", "3037000500", NumberValue(3037000500.0 * 3037000500.0)},
+		{"2", "**", "63", NumberValue(9223372036854775808)},
+		{"2", "**", "62", IntValue(1 << 62)},
+	}
+	for _, test := range tests {
+		// Literal operands are folded by the compiler; variables are not.
+		folded := fmt.Sprintf("var result = %s %s %s;", test.a, test.op, test.b)
+		runtime := fmt.Sprintf("var a = %s; var b = %s; var result = a %s b;", test.a, test.b, test.op)
+		for _, source := range []string{folded, runtime} {
+			if got := globalsAfter(t, source)["result"]; got != test.want {
+				t.Errorf("%s gave %#v, want %#v", source, got, test.want)
+			}
+		}
+	}
+}
+
+func TestIntegerLiterals(t *testing.T) {
+	globals := globalsAfter(t, `
+		var int = 10;
+		var float = 10.0;
+		var big = 9223372036854775808;
+		var min = -9223372036854775807 - 1;
+		var negatedMin = -(-9223372036854775807 - 1);
+	`)
+	want := map[StringValue]Value{"int": IntValue(10), "float": NumberValue(10), "big": NumberValue(9223372036854775808),
+		"min": IntValue(math.MinInt64), "negatedMin": NumberValue(9223372036854775808)}
+	for name, value := range want {
+		if globals[name] != value {
+			t.Errorf("%s = %#v, want %#v", name, globals[name], value)
+		}
+	}
+
+	expectOutput(t, "print 6 / 2; print 6 / 4; print 7 % 3; print 1 < 1.5; print 2 == 2.0;", "3\n1.5\n1\ntrue\ntrue\n")
+}
@@ -0,0 +1,110 @@
+package lox
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Profile counts how many instructions execute per source line and per
+// opcode while profiling is enabled on a Vm.
+type Profile struct {
+	lineHits   map[int]int
+	opcodeHits map[OpCode]int
+	// lineRuns counts how often execution reached the first instruction
+	// of a line's code, which approximates how often the line ran.
+	lineRuns map[int]int
+	// codeLines marks the lines that compiled to at least one instruction.
+	codeLines map[int]bool
+}
+
+func NewProfile() *Profile {
+	return &Profile{
+		lineHits:   map[int]int{},
+		opcodeHits: map[OpCode]int{},
+		lineRuns:   map[int]int{},
+		codeLines:  map[int]bool{},
+	}
+}
+
+func (profile *Profile) record(chunk *Chunk, offset int) {
+	line := chunk.lines[offset]
+	profile.lineHits[line]++
+	profile.opcodeHits[OpCode(chunk.code[offset])]++
+	if offset == 0 || chunk.lines[offset-1] != line {
+		profile.lineRuns[line]++
+	}
+}
+
+// addCode marks the lines of a chunk that is about to run, and of the
+// functions declared in it, as executable.
+func (profile *Profile) addCode(chunk *Chunk) {
+	for _, line := range chunk.lines {
+		profile.codeLines[line] = true
+	}
+	for _, constant := range chunk.constants {
+		if function, ok := constant.(*FunctionValue); ok {
+			profile.addCode(function.chunk)
+		}
+	}
+}
+
+// WriteReport writes the top source lines and opcodes by execution count.
+func (profile *Profile) WriteReport(w io.Writer, top int) {
+	lines := make([]int, 0, len(profile.lineHits))
+	for line := range profile.lineHits {
+		lines = append(lines, line)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := profile.lineHits[lines[i]], profile.lineHits[lines[j]]
+		return a > b || (a == b && lines[i] < lines[j])
+	})
+
+	ops := make([]OpCode, 0, len(profile.opcodeHits))
+	for op := range profile.opcodeHits {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		a, b := profile.opcodeHits[ops[i]], profile.opcodeHits[ops[j]]
+		return a > b || (a == b && ops[i] < ops[j])
+	})
+
+	fmt.Fprintf(w, "== hot lines ==\n")
+	for i, line := range lines {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(w, "line %4d %10d\n", line, profile.lineHits[line])
+	}
+	fmt.Fprintf(w, "== hot opcodes ==\n")
+	for i, op := range ops {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(w, "%-16s %10d\n", op, profile.opcodeHits[op])
+	}
+}
+
+// WriteCoverage writes the source with each line prefixed by how many
+// times it ran, in the style of gcov: "-" marks lines without code and
+// "#####" marks code that never ran.
+func (profile *Profile) WriteCoverage(w io.Writer, source string) {
+	lines := strings.Split(strings.TrimSuffix(source, "\n"), "\n")
+	for i, text := range lines {
+		line := i + 1
+		count := "-"
+		if profile.codeLines[line] {
+			switch runs := profile.lineRuns[line]; {
+			case profile.lineHits[line] == 0:
+				count = "#####"
+			case runs == 0:
+				// Execution only ever jumped into the middle of the line.
+				count = "1"
+			default:
+				count = fmt.Sprint(runs)
+			}
+		}
+		fmt.Fprintf(w, "%9s:%5d:%s\n", count, line, text)
+	}
+}
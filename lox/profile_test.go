@@ -0,0 +1,82 @@
+package lox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileReportsTheLoopBodyFirst(t *testing.T) {
+	vm, _, _ := newTestVm()
+	vm.EnableProfiling()
+	result := vm.Interpret(`var total = 0;
+var i = 0;
+while (i < 100) {
+  total = total + i * i - 1;
+  i = i + 1;
+}
+print total;
+`)
+	if result != InterpretOk {
+		t.Fatalf("Interpret = %d", result)
+	}
+	var report strings.Builder
+	vm.Profile().WriteReport(&report, 3)
+	lines := strings.Split(report.String(), "\n")
+	if lines[0] != "== hot lines ==" || !strings.HasPrefix(lines[1], "line    4 ") {
+		t.Errorf("line 4 doesn't top the report:\n%s", report.String())
+	}
+	// Each of the 100 iterations runs nine instructions on line 4.
+	if got := strings.Fields(lines[1])[2]; got != "900" {
+		t.Errorf("line 4 ran %s instructions, want 900", got)
+	}
+	if len(lines) != 9 || lines[4] != "== hot opcodes ==" {
+		t.Errorf("report isn't limited to the top 3:\n%s", report.String())
+	}
+}
+
+func TestProfilingIsOffByDefault(t *testing.T) {
+	vm, _, _ := newTestVm()
+	vm.Interpret("print 1;")
+	if vm.Profile() != nil {
+		t.Errorf("Profile() = %v, want nil", vm.Profile())
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	source := `var i = 0;
+// count to three
+while (i < 3) {
+  i = i + 1;
+}
+
+if (i == 3) {
+  i = 10;
+} else {
+  i = 20;
+}
+`
+	vm, _, _ := newTestVm()
+	vm.EnableProfiling()
+	if result := vm.Interpret(source); result != InterpretOk {
+		t.Fatalf("Interpret = %d", result)
+	}
+	var coverage strings.Builder
+	vm.Profile().WriteCoverage(&coverage, source)
+	// The loop condition runs once more than the body, and the jump over
+	// the else branch sits on the "} else {" line.
+	want := `        1:    1:var i = 0;
+        -:    2:// count to three
+        4:    3:while (i < 3) {
+        3:    4:  i = i + 1;
+        3:    5:}
+        -:    6:
+        1:    7:if (i == 3) {
+        1:    8:  i = 10;
+        1:    9:} else {
+    #####:   10:  i = 20;
+        -:   11:}
+`
+	if coverage.String() != want {
+		t.Errorf("coverage =\n%s\nwant\n%s", coverage.String(), want)
+	}
+}
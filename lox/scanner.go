@@ -1,10 +1,20 @@
 package lox
 
+import "unicode/utf8"
+
 type Scanner struct {
 	source  string
 	start   int
 	current int
 	line    int
+	// tokenLine and column locate the start of the token being scanned.
+	tokenLine int
+	column    int
+	// The column is counted incrementally: counted is how many
+	// characters of the current line come before the byte offset
+	// countedTo.
+	counted   int
+	countedTo int
 }
 
 type TokenType int
@@ -12,7 +22,30 @@ type TokenType int
 type Token struct {
 	tokenType TokenType
 	lexeme    string
-	line      int
+	// line is the line the token starts on.
+	line int
+	// column counts characters from 1 at the start of the line; a tab is
+	// a single character.
+	column int
+	// start and end are the byte offsets of the token in the source.
+	start int
+	end   int
+}
+
+func (token Token) Type() TokenType {
+	return token.tokenType
+}
+
+// Lexeme returns the token's text, or the message of an error token.
+func (token Token) Lexeme() string {
+	return token.lexeme
+}
+
+// Span returns the byte offsets of the token in the source, so that
+// source[start:end] is its text. For an error token it covers the
+// characters that were rejected.
+func (token Token) Span() (start, end int) {
+	return token.start, token.end
 }
 
 const (
@@ -27,6 +60,8 @@ const (
 	TokenSemicolon
 	TokenSlash
 	TokenStar
+	TokenStarStar
+	TokenPercent
 
 	TokenBang
 	TokenBangEqual
@@ -71,9 +106,15 @@ func NewScanner(source string) *Scanner {
 	}
 }
 
-func (scanner *Scanner) scanToken() Token {
+// ScanToken returns the next token, or a TokenEOF token once the source
+// is exhausted.
+func (scanner *Scanner) ScanToken() Token {
 	scanner.skipWhitespace()
 	scanner.start = scanner.current
+	scanner.tokenLine = scanner.line
+	scanner.counted += utf8.RuneCountInString(scanner.source[scanner.countedTo:scanner.start])
+	scanner.countedTo = scanner.start
+	scanner.column = scanner.counted + 1
 	if scanner.isAtEnd() {
 		return scanner.makeToken(TokenEOF)
 	}
@@ -106,7 +147,15 @@ func (scanner *Scanner) scanToken() Token {
 	case '/':
 		return scanner.makeToken(TokenSlash)
 	case '*':
-		return scanner.makeToken(TokenStar)
+		{
+			if scanner.match('*') {
+				return scanner.makeToken(TokenStarStar)
+			} else {
+				return scanner.makeToken(TokenStar)
+			}
+		}
+	case '%':
+		return scanner.makeToken(TokenPercent)
 	case '!':
 		{
 			if scanner.match('=') {
@@ -152,8 +201,8 @@ func (scanner *Scanner) skipWhitespace() {
 		case ' ', '\r', '\t':
 			scanner.advance()
 		case '\n':
-			scanner.line += 1
 			scanner.advance()
+			scanner.newline()
 		case '/':
 			if scanner.peekNext() == '/' {
 				for scanner.peek() != '\n' && !scanner.isAtEnd() {
@@ -168,8 +217,15 @@ func (scanner *Scanner) skipWhitespace() {
 	}
 }
 
+// newline records that the character just consumed ended a line.
+func (scanner *Scanner) newline() {
+	scanner.line += 1
+	scanner.counted = 0
+	scanner.countedTo = scanner.current
+}
+
 func (scanner *Scanner) peekNext() byte {
-	if scanner.isAtEnd() {
+	if scanner.current+1 >= len(scanner.source) {
 		return '\000'
 	}
 	return scanner.source[scanner.current+1]
@@ -206,7 +262,10 @@ func (scanner *Scanner) makeToken(tokenType TokenType) Token {
 	return Token{
 		tokenType: tokenType,
 		lexeme:    scanner.source[scanner.start:scanner.current],
-		line:      scanner.line,
+		line:      scanner.tokenLine,
+		column:    scanner.column,
+		start:     scanner.start,
+		end:       scanner.current,
 	}
 }
 
@@ -214,16 +273,18 @@ func (scanner *Scanner) errorToken(message string) Token {
 	return Token{
 		tokenType: TokenError,
 		lexeme:    message,
-		line:      scanner.line,
+		line:      scanner.tokenLine,
+		column:    scanner.column,
+		start:     scanner.start,
+		end:       scanner.current,
 	}
 }
 
 func (scanner *Scanner) string() Token {
 	for scanner.peek() != '"' && !scanner.isAtEnd() {
-		if scanner.peek() == '\n' {
-			scanner.line += 1
+		if scanner.advance() == '\n' {
+			scanner.newline()
 		}
-		scanner.advance()
 	}
 	if scanner.isAtEnd() {
 		return scanner.errorToken("Unterminated string.")
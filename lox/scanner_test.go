@@ -0,0 +1,73 @@
+package lox
+
+import (
+	"strings"
+	"testing"
+)
+
+// scanAll returns every token of source up to and including the EOF.
+func scanAll(source string) []Token {
+	scanner := NewScanner(source)
+	var tokens []Token
+	for {
+		token := scanner.ScanToken()
+		tokens = append(tokens, token)
+		if token.tokenType == TokenEOF {
+			return tokens
+		}
+	}
+}
+
+func TestTokenSpans(t *testing.T) {
+	source := "fun f(x) {\n  return x >= 1.5 and \"é\\n\"; // comment\n}\n"
+	for _, token := range scanAll(source) {
+		start, end := token.Span()
+		if source[start:end] != token.Lexeme() {
+			t.Errorf("%q spans %d:%d, which is %q", token.Lexeme(), start, end, source[start:end])
+		}
+	}
+
+	tokens := scanAll("a  <=\n\"é\"")
+	want := [][2]int{{0, 1}, {3, 5}, {6, 10}, {10, 10}}
+	for i, token := range tokens {
+		if start, end := token.Span(); start != want[i][0] || end != want[i][1] {
+			t.Errorf("%q spans %d:%d, want %d:%d", token.Lexeme(), start, end, want[i][0], want[i][1])
+		}
+	}
+
+	errorToken := scanAll("x @")[1]
+	if start, end := errorToken.Span(); errorToken.Type() != TokenError || start != 2 || end != 3 {
+		t.Errorf("error token %q spans %d:%d, want 2:3", errorToken.Lexeme(), start, end)
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	source := "var x = 1;\n\tprint \"é\" + x; // done\n\"two\nlines\" x;\n  @"
+	want := []struct {
+		lexeme string
+		line   int
+		column int
+	}{
+		{"var", 1, 1}, {"x", 1, 5}, {"=", 1, 7}, {"1", 1, 9}, {";", 1, 10},
+		{"print", 2, 2}, {"\"é\"", 2, 8}, {"+", 2, 12}, {"x", 2, 14}, {";", 2, 15},
+		{"\"two\nlines\"", 3, 1}, {"x", 4, 8}, {";", 4, 9},
+		{"Unexpected character.", 5, 3}, {"", 5, 4},
+	}
+	tokens := scanAll(source)
+	if len(tokens) != len(want) {
+		t.Fatalf("scanned %d tokens, want %d", len(tokens), len(want))
+	}
+	for i, token := range tokens {
+		if token.lexeme != want[i].lexeme || token.line != want[i].line || token.column != want[i].column {
+			t.Errorf("token %d is %q at %d:%d, want %q at %d:%d", i, token.lexeme, token.line, token.column,
+				want[i].lexeme, want[i].line, want[i].column)
+		}
+	}
+}
+
+func BenchmarkScanLongLine(b *testing.B) {
+	source := strings.Repeat("x + ", 50000) + "x;"
+	for i := 0; i < b.N; i++ {
+		scanAll(source)
+	}
+}
@@ -0,0 +1,254 @@
+package lox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Compiled chunks are stored as the magic bytes, a format version and the
+// top-level chunk. Lengths and counts are unsigned varints.
+//
+// A chunk is its code bytes, one line number per code byte and its
+// constant pool. Each constant starts with a tag byte: floats are
+// followed by their IEEE 754 bits as a little-endian uint64, integers by
+// their two's complement bits likewise, strings by their length and
+// bytes, bools by a 0 or 1 byte, and functions by their name, arity,
+// upvalue count and their own chunk. Nil has no payload.
+const (
+	chunkMagic   = "LOXC"
+	chunkVersion = 2
+)
+
+const (
+	tagNil byte = iota
+	tagBool
+	tagNumber
+	tagString
+	tagFunction
+	tagInt
+)
+
+// chunkWriter writes the serialized form, remembering the first error so
+// callers only need to check once at the end.
+type chunkWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// Serialize writes the chunk, including the chunks of the functions it
+// declares, in the versioned binary format described above.
+func (chunk *Chunk) Serialize(w io.Writer) error {
+	writer := &chunkWriter{w: bufio.NewWriter(w)}
+	writer.bytes([]byte(chunkMagic))
+	writer.uint(chunkVersion)
+	writer.chunk(chunk)
+	if writer.err != nil {
+		return writer.err
+	}
+	return writer.w.Flush()
+}
+
+func (writer *chunkWriter) chunk(chunk *Chunk) {
+	writer.uint(uint64(len(chunk.code)))
+	writer.bytes(chunk.code)
+	for _, line := range chunk.lines {
+		writer.uint(uint64(line))
+	}
+	writer.uint(uint64(len(chunk.constants)))
+	for _, constant := range chunk.constants {
+		writer.constant(constant)
+	}
+}
+
+func (writer *chunkWriter) constant(value Value) {
+	switch value := value.(type) {
+	case NilValue:
+		writer.bytes([]byte{tagNil})
+	case BoolValue:
+		b := byte(0)
+		if value {
+			b = 1
+		}
+		writer.bytes([]byte{tagBool, b})
+	case NumberValue:
+		var bits [8]byte
+		binary.LittleEndian.PutUint64(bits[:], math.Float64bits(float64(value)))
+		writer.bytes([]byte{tagNumber})
+		writer.bytes(bits[:])
+	case IntValue:
+		var bits [8]byte
+		binary.LittleEndian.PutUint64(bits[:], uint64(value))
+		writer.bytes([]byte{tagInt})
+		writer.bytes(bits[:])
+	case StringValue:
+		writer.bytes([]byte{tagString})
+		writer.string(string(value))
+	case *FunctionValue:
+		writer.bytes([]byte{tagFunction})
+		writer.string(value.name)
+		writer.uint(uint64(value.arity))
+		writer.uint(uint64(value.upvalueCount))
+		writer.chunk(value.chunk)
+	default:
+		if writer.err == nil {
+			writer.err = fmt.Errorf("can't serialize constant %s", value)
+		}
+	}
+}
+
+func (writer *chunkWriter) string(s string) {
+	writer.uint(uint64(len(s)))
+	writer.bytes([]byte(s))
+}
+
+func (writer *chunkWriter) uint(n uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	writer.bytes(buffer[:binary.PutUvarint(buffer[:], n)])
+}
+
+func (writer *chunkWriter) bytes(b []byte) {
+	if writer.err != nil {
+		return
+	}
+	_, writer.err = writer.w.Write(b)
+}
+
+var errTruncated = errors.New("truncated chunk")
+
+// chunkReader decodes the serialized form from memory, so that lengths
+// read from the input can be checked against what is actually there
+// before anything is allocated.
+type chunkReader struct {
+	data []byte
+	err  error
+}
+
+// LoadChunk reads a chunk written by Serialize. The result is validated
+// before it is returned, so it is safe to run.
+func LoadChunk(r io.Reader) (*Chunk, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	reader := &chunkReader{data: data}
+	if magic := reader.bytes(len(chunkMagic)); reader.err == nil && string(magic) != chunkMagic {
+		return nil, fmt.Errorf("not a compiled lox chunk")
+	}
+	if version := reader.uint(); reader.err == nil && version != chunkVersion {
+		return nil, fmt.Errorf("unsupported chunk version %d", version)
+	}
+	chunk := reader.chunk()
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if len(reader.data) != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes after chunk", len(reader.data))
+	}
+	if err := chunk.Validate(); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+func (reader *chunkReader) chunk() *Chunk {
+	chunk := NewChunk()
+	chunk.code = append(chunk.code, reader.bytes(reader.length())...)
+	for range chunk.code {
+		chunk.lines = append(chunk.lines, int(reader.uint()))
+	}
+	count := reader.length()
+	for i := 0; i < count && reader.err == nil; i++ {
+		chunk.constants = append(chunk.constants, reader.constant())
+	}
+	return chunk
+}
+
+func (reader *chunkReader) constant() Value {
+	tag := reader.bytes(1)
+	if reader.err != nil {
+		return Nil
+	}
+	switch tag[0] {
+	case tagNil:
+		return Nil
+	case tagBool:
+		b := reader.bytes(1)
+		if reader.err != nil {
+			return Nil
+		}
+		return BoolValue(b[0] != 0)
+	case tagNumber:
+		bits := reader.bytes(8)
+		if reader.err != nil {
+			return Nil
+		}
+		return NumberValue(math.Float64frombits(binary.LittleEndian.Uint64(bits)))
+	case tagInt:
+		bits := reader.bytes(8)
+		if reader.err != nil {
+			return Nil
+		}
+		return IntValue(binary.LittleEndian.Uint64(bits))
+	case tagString:
+		return StringValue(reader.string())
+	case tagFunction:
+		function := NewFunctionValue()
+		function.name = reader.string()
+		function.arity = int(reader.uint())
+		function.upvalueCount = int(reader.uint())
+		function.chunk = reader.chunk()
+		return function
+	default:
+		if reader.err == nil {
+			reader.err = fmt.Errorf("unknown constant tag %d", tag[0])
+		}
+		return Nil
+	}
+}
+
+func (reader *chunkReader) string() string {
+	return string(reader.bytes(reader.length()))
+}
+
+// length reads a count of items that each take at least one byte, which
+// bounds it by the remaining input.
+func (reader *chunkReader) length() int {
+	n := reader.uint()
+	if reader.err == nil && n > uint64(len(reader.data)) {
+		reader.err = errTruncated
+	}
+	if reader.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (reader *chunkReader) uint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(reader.data)
+	if size <= 0 {
+		reader.err = errTruncated
+		return 0
+	}
+	reader.data = reader.data[size:]
+	return n
+}
+
+func (reader *chunkReader) bytes(n int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if n > len(reader.data) {
+		reader.err = errTruncated
+		return nil
+	}
+	b := reader.data[:n]
+	reader.data = reader.data[n:]
+	return b
+}
@@ -0,0 +1,132 @@
+package lox
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+const serializeSource = `
+	class Counter {
+		init(start) { this.count = start; }
+		next() { this.count = this.count + 1; return this.count; }
+	}
+	fun makeAdder(n) {
+		fun add(x) { return x + n; }
+		return add;
+	}
+	var counter = Counter(40);
+	counter.next();
+	print counter.next();
+	print makeAdder(1000000)(0.5);
+	print "done" + "!";
+`
+
+func serialized(t *testing.T, chunk *Chunk) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := chunk.Serialize(&buffer); err != nil {
+		t.Fatalf("Serialize() = %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestSerializeFormat(t *testing.T) {
+	chunk := chunkOf(byte(OpNil), byte(OpReturn))
+	chunk.lines[1] = 300
+	for _, constant := range []Value{Nil, BoolValue(true), NumberValue(1.5), StringValue("hé")} {
+		chunk.AddConstant(constant)
+	}
+	want := []byte{
+		'L', 'O', 'X', 'C', 2,
+		2, byte(OpNil), byte(OpReturn),
+		1, 0xac, 0x02, // lines 1 and 300
+		4,
+		tagNil,
+		tagBool, 1,
+		tagNumber, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f,
+		tagString, 3, 'h', 0xc3, 0xa9,
+	}
+	if got := serialized(t, chunk); !bytes.Equal(got, want) {
+		t.Errorf("Serialize() =\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestSerializeIsDeterministic(t *testing.T) {
+	first := serialized(t, mustCompile(t, serializeSource))
+	second := serialized(t, mustCompile(t, serializeSource))
+	if !bytes.Equal(first, second) {
+		t.Errorf("two compilations serialized differently")
+	}
+	if !bytes.HasPrefix(first, []byte("LOXC\x02")) {
+		t.Errorf("output starts with %q, want the header", first[:5])
+	}
+}
+
+func TestSerializeRejectsRuntimeValues(t *testing.T) {
+	chunk := chunkOf(byte(OpNil), byte(OpReturn))
+	chunk.AddConstant(&NativeValue{name: "clock"})
+	var buffer bytes.Buffer
+	if err := chunk.Serialize(&buffer); err == nil || err.Error() != "can't serialize constant <native fn>" {
+		t.Errorf("Serialize() = %v", err)
+	}
+}
+
+// roundTrip serializes a chunk and loads it back.
+func roundTrip(t *testing.T, chunk *Chunk) *Chunk {
+	t.Helper()
+	loaded, err := LoadChunk(bytes.NewReader(serialized(t, chunk)))
+	if err != nil {
+		t.Fatalf("LoadChunk() = %v", err)
+	}
+	return loaded
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	loaded := roundTrip(t, mustCompile(t, serializeSource))
+	if fresh := mustCompile(t, serializeSource); !reflect.DeepEqual(loaded, fresh) {
+		t.Errorf("loaded chunk differs from a freshly compiled one")
+	}
+
+	vm, out, errOut := newTestVm()
+	if result := vm.RunCompiled(loaded); result != InterpretOk {
+		t.Fatalf("RunCompiled = %d; errors:\n%s", result, errOut)
+	}
+	if want := "42\n1.0000005e+06\ndone!\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+}
+
+func TestSerializeConstants(t *testing.T) {
+	chunk := chunkOf(byte(OpNil), byte(OpReturn))
+	constants := []Value{Nil, BoolValue(true), BoolValue(false), IntValue(math.MinInt64), IntValue(0), NumberValue(math.MaxInt64), NumberValue(-0.25),
+		NumberValue(math.Inf(1)), StringValue(""), StringValue("héllo\n")}
+	for _, constant := range constants {
+		chunk.AddConstant(constant)
+	}
+	loaded := roundTrip(t, chunk)
+	if !reflect.DeepEqual(loaded.constants, constants) {
+		t.Errorf("constants = %v, want %v", loaded.constants, constants)
+	}
+}
+
+func TestLoadChunkRejectsBadInput(t *testing.T) {
+	valid := serialized(t, mustCompile(t, "print 1;"))
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"magic", []byte("LOXD\x02"), "not a compiled lox chunk"},
+		{"version", []byte("LOXC\x01"), "unsupported chunk version 1"},
+		{"truncated", valid[:len(valid)-1], "truncated chunk"},
+		{"trailing", append(append([]byte{}, valid...), 0, 0), "2 unexpected bytes after chunk"},
+		{"invalid", serialized(t, chunkOf(byte(OpConstant), 3, byte(OpReturn))), "constant index 3 out of range at offset 0"},
+	}
+	for _, test := range tests {
+		if _, err := LoadChunk(bytes.NewReader(test.data)); err == nil || err.Error() != test.want {
+			t.Errorf("%s: LoadChunk() = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package lox
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ChunkStats summarizes the compiled size and shape of a chunk, including
+// the chunks of every function declared in it.
+type ChunkStats struct {
+	Instructions int
+	Bytes        int
+	Constants    int
+	Opcodes      map[OpCode]int
+	// MaxJump is the largest distance in bytes covered by a jump or loop.
+	MaxJump int
+}
+
+// Stats walks the chunk instruction by instruction. The chunk must be
+// well formed; see Validate.
+func (chunk *Chunk) Stats() ChunkStats {
+	stats := ChunkStats{Opcodes: map[OpCode]int{}}
+	chunk.collectStats(&stats)
+	return stats
+}
+
+func (chunk *Chunk) collectStats(stats *ChunkStats) {
+	stats.Bytes += len(chunk.code)
+	stats.Constants += len(chunk.constants)
+	for offset := 0; offset < len(chunk.code); offset += chunk.instructionSize(offset) {
+		op := OpCode(chunk.code[offset])
+		stats.Instructions++
+		stats.Opcodes[op]++
+		switch op {
+		case OpJumpIfFalse, OpJump, OpLoop:
+			distance := int(chunk.code[offset+1])<<8 | int(chunk.code[offset+2])
+			if distance > stats.MaxJump {
+				stats.MaxJump = distance
+			}
+		}
+	}
+	for _, constant := range chunk.constants {
+		if function, ok := constant.(*FunctionValue); ok {
+			function.chunk.collectStats(stats)
+		}
+	}
+}
+
+// WriteReport writes the totals followed by the opcode histogram, most
+// frequent first.
+func (stats ChunkStats) WriteReport(w io.Writer) {
+	ops := make([]OpCode, 0, len(stats.Opcodes))
+	for op := range stats.Opcodes {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		a, b := stats.Opcodes[ops[i]], stats.Opcodes[ops[j]]
+		return a > b || (a == b && ops[i] < ops[j])
+	})
+
+	fmt.Fprintf(w, "instructions %10d\n", stats.Instructions)
+	fmt.Fprintf(w, "bytes        %10d\n", stats.Bytes)
+	fmt.Fprintf(w, "constants    %10d\n", stats.Constants)
+	fmt.Fprintf(w, "max jump     %10d\n", stats.MaxJump)
+	fmt.Fprintf(w, "== opcodes ==\n")
+	for _, op := range ops {
+		fmt.Fprintf(w, "%-16s %10d\n", op, stats.Opcodes[op])
+	}
+}
@@ -0,0 +1,45 @@
+package lox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatsCountsInstructions(t *testing.T) {
+	chunk := mustCompile(t, "var a = 1;\nvar b = a + a;\nprint b;")
+	stats := chunk.Stats()
+	// OP_IMMEDIATE, 2x OP_DEFINE_GLOBAL, 3x OP_GET_GLOBAL, OP_ADD, OP_PRINT,
+	// and the implicit OP_NIL, OP_RETURN.
+	if stats.Instructions != 10 {
+		t.Errorf("Instructions = %d, want 10", stats.Instructions)
+	}
+	if stats.Bytes != 16 {
+		t.Errorf("Bytes = %d, want 16", stats.Bytes)
+	}
+	if got := stats.Opcodes[OpGetGlobal]; got != 3 {
+		t.Errorf("OP_GET_GLOBAL count = %d, want 3", got)
+	}
+	if got := stats.Opcodes[OpAdd]; got != 1 {
+		t.Errorf("OP_ADD count = %d, want 1", got)
+	}
+}
+
+func TestStatsIncludesNestedFunctions(t *testing.T) {
+	chunk := mustCompile(t, "fun f(a) { return a + 2; }")
+	if got := chunk.Stats().Opcodes[OpAdd]; got != 1 {
+		t.Errorf("OP_ADD count = %d, want the one inside f", got)
+	}
+}
+
+func TestStatsReportListsMostFrequentFirst(t *testing.T) {
+	chunk := mustCompile(t, "var a = 1;\nprint a + a + a;")
+	var report strings.Builder
+	chunk.Stats().WriteReport(&report)
+	lines := strings.Split(report.String(), "\n")
+	if lines[0] != "instructions         10" {
+		t.Errorf("first line = %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[5], "OP_GET_GLOBAL ") || !strings.HasSuffix(lines[5], " 3") {
+		t.Errorf("top opcode line = %q, want OP_GET_GLOBAL with 3", lines[5])
+	}
+}
@@ -1,48 +1,398 @@
 package lox
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 type Value interface {
-	print()
+	String() string
+	Type() ValueType
 	isTruthy() bool
 }
 
+// ValueType identifies the kind of a Value, letting callers switch on it
+// without a chain of type assertions.
+type ValueType int
+
+const (
+	TypeNil ValueType = iota
+	TypeBool
+	TypeNumber
+	TypeInt
+	TypeString
+	TypeFunction
+	TypeClosure
+	TypeNative
+	TypeClass
+	TypeInstance
+	TypeBoundMethod
+	TypeStringBuilder
+	TypeBytes
+)
+
+var typeNames = [...]string{
+	TypeNil:           "nil",
+	TypeBool:          "bool",
+	TypeNumber:        "number",
+	TypeInt:           "int",
+	TypeString:        "string",
+	TypeFunction:      "function",
+	TypeClosure:       "closure",
+	TypeNative:        "native",
+	TypeClass:         "class",
+	TypeInstance:      "instance",
+	TypeBoundMethod:   "bound method",
+	TypeStringBuilder: "string builder",
+	TypeBytes:         "bytes",
+}
+
+func (valueType ValueType) String() string {
+	if valueType < 0 || int(valueType) >= len(typeNames) {
+		return fmt.Sprintf("type(%d)", int(valueType))
+	}
+	return typeNames[valueType]
+}
+
 type BoolValue bool
 
-func (value BoolValue) print() {
-	fmt.Print(value)
+func (value BoolValue) String() string {
+	return fmt.Sprint(bool(value))
 }
 
 func (value BoolValue) isTruthy() bool {
 	return bool(value)
 }
 
+func (BoolValue) Type() ValueType {
+	return TypeBool
+}
+
 type NilValue struct{}
 
-func (NilValue) print() {
-	fmt.Print("nil")
+// Nil is the nil value. Every nil the VM produces is Nil, and since
+// NilValue has no fields, nil == nil holds under Go's '=='.
+var Nil = NilValue{}
+
+func (NilValue) String() string {
+	return "nil"
 }
 
 func (NilValue) isTruthy() bool {
 	return false
 }
 
+func (NilValue) Type() ValueType {
+	return TypeNil
+}
+
 type NumberValue float64
 
-func (value NumberValue) print() {
-	fmt.Printf("%g", value)
+func (value NumberValue) String() string {
+	return fmt.Sprintf("%g", float64(value))
 }
 
 func (value NumberValue) isTruthy() bool {
 	return true
 }
 
+func (NumberValue) Type() ValueType {
+	return TypeNumber
+}
+
+// IntValue is an integer. Integer literals and arithmetic on integers
+// that stays whole produce it; see arithmetic.
+type IntValue int64
+
+func (value IntValue) String() string {
+	return strconv.FormatInt(int64(value), 10)
+}
+
+func (value IntValue) isTruthy() bool {
+	return true
+}
+
+func (IntValue) Type() ValueType {
+	return TypeInt
+}
+
 type StringValue string
 
-func (value StringValue) print() {
-	fmt.Print(value)
+func (value StringValue) String() string {
+	return string(value)
 }
 
 func (value StringValue) isTruthy() bool {
 	return true
 }
+
+func (StringValue) Type() ValueType {
+	return TypeString
+}
+
+type FunctionValue struct {
+	arity        int
+	upvalueCount int
+	chunk        *Chunk
+	name         string
+}
+
+func NewFunctionValue() *FunctionValue {
+	return &FunctionValue{
+		arity:        0,
+		upvalueCount: 0,
+		chunk:        NewChunk(),
+		name:         "",
+	}
+}
+
+func (function *FunctionValue) String() string {
+	if function.name == "" {
+		return "<script>"
+	}
+	return fmt.Sprintf("<fn %s>", function.name)
+}
+
+func (function *FunctionValue) isTruthy() bool {
+	return true
+}
+
+func (*FunctionValue) Type() ValueType {
+	return TypeFunction
+}
+
+// ClosureValue is a function together with the variables it captured
+// from enclosing functions. All Lox functions are called as closures.
+type ClosureValue struct {
+	function *FunctionValue
+	upvalues []*RuntimeUpvalue
+}
+
+func NewClosureValue(function *FunctionValue) *ClosureValue {
+	return &ClosureValue{
+		function: function,
+		upvalues: make([]*RuntimeUpvalue, function.upvalueCount),
+	}
+}
+
+func (closure *ClosureValue) String() string {
+	return closure.function.String()
+}
+
+func (closure *ClosureValue) isTruthy() bool {
+	return true
+}
+
+func (*ClosureValue) Type() ValueType {
+	return TypeClosure
+}
+
+// RuntimeUpvalue is a variable captured by a closure. While the variable
+// is still on the stack the upvalue is open and refers to its slot; once
+// the slot is discarded the value is moved into closed.
+type RuntimeUpvalue struct {
+	location int
+	closed   Value
+	isOpen   bool
+	next     *RuntimeUpvalue
+}
+
+type ClassValue struct {
+	name    string
+	methods map[StringValue]*ClosureValue
+}
+
+func NewClassValue(name string) *ClassValue {
+	return &ClassValue{
+		name:    name,
+		methods: make(map[StringValue]*ClosureValue),
+	}
+}
+
+func (class *ClassValue) String() string {
+	return class.name
+}
+
+func (class *ClassValue) isTruthy() bool {
+	return true
+}
+
+func (*ClassValue) Type() ValueType {
+	return TypeClass
+}
+
+type InstanceValue struct {
+	class  *ClassValue
+	fields map[StringValue]Value
+}
+
+func NewInstanceValue(class *ClassValue) *InstanceValue {
+	return &InstanceValue{
+		class:  class,
+		fields: make(map[StringValue]Value),
+	}
+}
+
+func (instance *InstanceValue) String() string {
+	return fmt.Sprintf("%s instance", instance.class.name)
+}
+
+func (instance *InstanceValue) isTruthy() bool {
+	return true
+}
+
+func (*InstanceValue) Type() ValueType {
+	return TypeInstance
+}
+
+// BoundMethodValue is a method looked up on an instance. Calling it
+// places the receiver in slot zero, where the method finds 'this'.
+type BoundMethodValue struct {
+	receiver Value
+	method   *ClosureValue
+}
+
+func NewBoundMethodValue(receiver Value, method *ClosureValue) *BoundMethodValue {
+	return &BoundMethodValue{receiver: receiver, method: method}
+}
+
+func (bound *BoundMethodValue) String() string {
+	return bound.method.String()
+}
+
+func (bound *BoundMethodValue) isTruthy() bool {
+	return true
+}
+
+func (*BoundMethodValue) Type() ValueType {
+	return TypeBoundMethod
+}
+
+// StringBuilderValue accumulates a string piece by piece, avoiding the
+// quadratic cost of building it with repeated '+'.
+type StringBuilderValue struct {
+	builder strings.Builder
+}
+
+func (builder *StringBuilderValue) String() string {
+	return "<string builder>"
+}
+
+func (builder *StringBuilderValue) isTruthy() bool {
+	return true
+}
+
+func (*StringBuilderValue) Type() ValueType {
+	return TypeStringBuilder
+}
+
+// BytesValue is a mutable sequence of bytes. Unlike a string it may hold
+// data that isn't valid UTF-8.
+type BytesValue struct {
+	data []byte
+}
+
+func (bytes *BytesValue) String() string {
+	return fmt.Sprintf("b%q", bytes.data)
+}
+
+func (bytes *BytesValue) isTruthy() bool {
+	return true
+}
+
+func (*BytesValue) Type() ValueType {
+	return TypeBytes
+}
+
+// valuesEqual implements '=='. Values of different types are never equal,
+// except that an integer equals a float with the same value. Floats
+// compare as floats, so NaN is unequal to itself and -0 equals 0; strings
+// compare by content and every other object by identity.
+func valuesEqual(a, b Value) bool {
+	if isNumber(a.Type()) && isNumber(b.Type()) {
+		if x, ok := a.(IntValue); ok {
+			if y, ok := b.(IntValue); ok {
+				return x == y
+			}
+		}
+		return toFloat(a) == toFloat(b)
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a := a.(type) {
+	case StringValue:
+		return a == b.(StringValue)
+	case BoolValue:
+		return a == b.(BoolValue)
+	case NilValue:
+		return true
+	default:
+		return a == b
+	}
+}
+
+// deepEqual reports whether two values have the same structure. Pairs
+// already being compared are assumed equal, so cyclic instances
+// terminate.
+func deepEqual(a, b Value, comparing map[[2]Value]bool) bool {
+	if valuesEqual(a, b) {
+		return true
+	}
+	switch a := a.(type) {
+	case *BytesValue:
+		b, ok := b.(*BytesValue)
+		return ok && string(a.data) == string(b.data)
+	case *InstanceValue:
+		b, ok := b.(*InstanceValue)
+		if !ok || a.class != b.class || len(a.fields) != len(b.fields) {
+			return false
+		}
+		pair := [2]Value{a, b}
+		if comparing[pair] {
+			return true
+		}
+		comparing[pair] = true
+		for name, value := range a.fields {
+			other, ok := b.fields[name]
+			if !ok || !deepEqual(value, other, comparing) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isCallable reports whether a call expression accepts the value as its
+// callee.
+func isCallable(value Value) bool {
+	switch value.(type) {
+	case *ClosureValue, *NativeValue, *ClassValue, *BoundMethodValue:
+		return true
+	}
+	return false
+}
+
+// NativeFn implements a native function. Returning an error raises a
+// runtime error with its message.
+type NativeFn func(args []Value) (Value, error)
+
+type NativeValue struct {
+	name     string
+	arity    int
+	function NativeFn
+}
+
+func (native *NativeValue) String() string {
+	return "<native fn>"
+}
+
+func (native *NativeValue) isTruthy() bool {
+	return true
+}
+
+func (*NativeValue) Type() ValueType {
+	return TypeNative
+}
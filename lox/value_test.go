@@ -0,0 +1,78 @@
+package lox
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValueType(t *testing.T) {
+	function := NewFunctionValue()
+	closure := NewClosureValue(function)
+	class := NewClassValue("Point")
+	instance := NewInstanceValue(class)
+	tests := []struct {
+		value Value
+		want  ValueType
+		name  string
+	}{
+		{Nil, TypeNil, "nil"},
+		{BoolValue(false), TypeBool, "bool"},
+		{NumberValue(1.5), TypeNumber, "number"},
+		{StringValue("s"), TypeString, "string"},
+		{function, TypeFunction, "function"},
+		{closure, TypeClosure, "closure"},
+		{&NativeValue{name: "clock"}, TypeNative, "native"},
+		{class, TypeClass, "class"},
+		{instance, TypeInstance, "instance"},
+		{NewBoundMethodValue(instance, closure), TypeBoundMethod, "bound method"},
+		{&StringBuilderValue{}, TypeStringBuilder, "string builder"},
+		{&BytesValue{}, TypeBytes, "bytes"},
+	}
+	for _, test := range tests {
+		if got := test.value.Type(); got != test.want || got.String() != test.name {
+			t.Errorf("%T.Type() = %v, want %v", test.value, got, test.name)
+		}
+	}
+	if got := ValueType(-1).String(); got != "type(-1)" {
+		t.Errorf("ValueType(-1).String() = %q", got)
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	nan := NumberValue(math.NaN())
+	class := NewClassValue("C")
+	tests := []struct {
+		a, b Value
+		want bool
+	}{
+		{nan, nan, false},
+		{nan, NumberValue(1), false},
+		{NumberValue(math.Copysign(0, -1)), NumberValue(0), true},
+		{NumberValue(math.Inf(1)), NumberValue(math.Inf(1)), true},
+		{StringValue("a"), StringValue("a"), true},
+		{StringValue("1"), NumberValue(1), false},
+		{BoolValue(false), Nil, false},
+		{NumberValue(0), BoolValue(false), false},
+		{Nil, Nil, true},
+		{class, class, true},
+		{class, NewClassValue("C"), false},
+	}
+	for _, test := range tests {
+		if got := valuesEqual(test.a, test.b); got != test.want {
+			t.Errorf("valuesEqual(%s, %s) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestEqualityOperators(t *testing.T) {
+	expectOutput(t, `
+		var nan = 0 / 0;
+		print nan == nan;
+		print nan != nan;
+		print -0.0 == 0.0;
+		print 1 == 1.0;
+		print "1" == 1;
+		print nil == false;
+		print !(nan == nan);
+	`, "false\ntrue\ntrue\ntrue\nfalse\nfalse\ntrue\n")
+}
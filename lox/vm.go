@@ -1,15 +1,108 @@
 package lox
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 )
 
+// DefaultMaxCallDepth is the default limit on nested calls.
+const DefaultMaxCallDepth = 1000
+
+// DefaultMaxStack is the default limit on the number of values on the
+// stack.
+const DefaultMaxStack = 64 * 256
+
+// initialStack is how many stack slots a new Vm starts with.
+const initialStack = 256
+
+// traceFrames is how many frames at each end of a long stack trace are
+// shown; the frames in between are summarized.
+const traceFrames = 10
+
 type Vm struct {
-	chunk   *Chunk
+	frames []CallFrame
+	// stack holds the live values below stackTop. It starts small and
+	// grows by doubling up to maxStack; anything that refers into it keeps
+	// an index, never a pointer, so growing it is safe.
+	stack        []Value
+	stackTop     int
+	openUpvalues *RuntimeUpvalue
+	globals      *Globals
+	displayMode  DisplayMode
+	truthiness   Truthiness
+	division     Division
+	logLevel     LogLevel
+	// globalCells caches, for each chunk called during the current run,
+	// the global cells its instructions resolved, indexed by the name's
+	// constant. It belongs to the Vm rather than the chunk so that one
+	// chunk can run on several VMs at once, and is dropped after each run
+	// so it never outlives the chunks or the globals it refers to.
+	globalCells map[*Chunk][]*globalCell
+	// assignmentCheck and maxErrors are passed on to every compiler the
+	// Vm creates.
+	assignmentCheck AssignmentCheck
+	maxErrors       int
+	profile         *Profile
+	startTime       time.Time
+	// now is the clock behind clock() and now(), and sleep is what sleep()
+	// waits with; Deterministic replaces both.
+	now   func() time.Time
+	sleep func(time.Duration) error
+	// ctx interrupts sleep() once it is done.
+	ctx          context.Context
+	random       *rand.Rand
+	regexps      map[string]*regexp.Regexp
+	maxStack     int
+	maxCallDepth int
+	// traceExecution prints every instruction before it runs.
+	traceExecution bool
+	// allowEval defines the eval native.
+	allowEval bool
+	// out receives the output of print statements, after onPrint.
+	out     io.Writer
+	onPrint PrintHook
+	// in is where read_line reads from.
+	in *bufio.Reader
+	// errOut receives the output of eprint and every compile and runtime
+	// error; errors keeps the errors of the last Interpret call.
+	errOut io.Writer
+	errors []string
+	// nested counts the calls natives are running through callNested.
+	// While it is positive a runtime error is kept in nestedError for the
+	// native to handle instead of being reported.
+	nested      int
+	nestedError string
+}
+
+// Option configures a Vm when it is created.
+type Option func(*Vm)
+
+// WithMaxStack limits how many values the stack may hold; exceeding it is
+// a "Stack overflow." runtime error. Limits below 1 are ignored.
+func WithMaxStack(max int) Option {
+	return func(vm *Vm) {
+		if max > 0 {
+			vm.maxStack = max
+		}
+	}
+}
+
+// CallFrame is an in-progress call: the closure being run, its own
+// instruction pointer and the stack index of its slot zero.
+type CallFrame struct {
+	closure *ClosureValue
 	ip      int
-	stack   []Value
-	globals map[StringValue]Value
+	slots   int
+	// globalCells is the Vm's cache of globals for the closure's chunk.
+	globalCells []*globalCell
 }
 
 type InterpretResult int
@@ -20,190 +113,896 @@ const (
 	InterpretRuntimeError
 )
 
-func NewVm() *Vm {
-	return &Vm{
-		chunk:   NewChunk(),
-		ip:      0,
-		stack:   make([]Value, 0),
-		globals: map[StringValue]Value{},
+// DisplayMode controls how print renders whole-valued floats. Integers
+// always print without a fractional part.
+type DisplayMode int
+
+const (
+	// DisplayExact keeps the fractional part of whole floats, printing 3.0,
+	// so they can be told apart from the integer 3. It is the default.
+	DisplayExact DisplayMode = iota
+	// DisplayCompact prints 3.0 as 3, which the REPL uses.
+	DisplayCompact
+)
+
+// Truthiness selects which values conditions and '!' treat as false.
+type Truthiness int
+
+const (
+	// TruthinessStrict is standard Lox: only nil and false are falsey.
+	TruthinessStrict Truthiness = iota
+	// TruthinessLoose also treats 0 and "" as falsey.
+	TruthinessLoose
+)
+
+// Division selects what '/' and '%' do with a zero divisor.
+type Division int
+
+const (
+	// DivisionIEEE follows IEEE 754: 1 / 0 is +Inf, 0 / 0 and 1 % 0 are NaN.
+	DivisionIEEE Division = iota
+	// DivisionChecked makes a zero divisor a runtime error.
+	DivisionChecked
+)
+
+// LogLevel is the severity of a message passed to the log native.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = [...]string{
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+func NewVm(options ...Option) *Vm {
+	vm := &Vm{
+		frames:       make([]CallFrame, 0, 64),
+		globals:      NewGlobals(),
+		globalCells:  map[*Chunk][]*globalCell{},
+		displayMode:  DisplayExact,
+		truthiness:   TruthinessStrict,
+		division:     DivisionIEEE,
+		logLevel:     LogInfo,
+		startTime:    time.Now(),
+		now:          time.Now,
+		ctx:          context.Background(),
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		regexps:      map[string]*regexp.Regexp{},
+		maxStack:     DefaultMaxStack,
+		maxCallDepth: DefaultMaxCallDepth,
+		maxErrors:    DefaultMaxErrors,
+		out:          os.Stdout,
+		in:           bufio.NewReader(os.Stdin),
+		errOut:       os.Stderr,
+	}
+	vm.sleep = vm.sleepFor
+	for _, option := range options {
+		option(vm)
+	}
+	vm.stack = make([]Value, initialStack)
+	if vm.maxStack < initialStack {
+		vm.stack = vm.stack[:vm.maxStack]
+	}
+	vm.defineNatives()
+	return vm
+}
+
+func (vm *Vm) SetDisplayMode(mode DisplayMode) {
+	vm.displayMode = mode
+}
+
+func (vm *Vm) SetTruthiness(truthiness Truthiness) {
+	vm.truthiness = truthiness
+}
+
+// WithOutput sends the output of print statements to w instead of
+// stdout.
+func WithOutput(w io.Writer) Option {
+	return func(vm *Vm) {
+		vm.out = w
+	}
+}
+
+// WithInput makes read_line read from r instead of stdin. Passing a
+// *bufio.Reader lets the Vm share its buffer with other readers of the
+// same input, such as a REPL.
+func WithInput(r io.Reader) Option {
+	return func(vm *Vm) {
+		if reader, ok := r.(*bufio.Reader); ok {
+			vm.in = reader
+		} else {
+			vm.in = bufio.NewReader(r)
+		}
+	}
+}
+
+// PrintHook receives each value a print statement prints. Returning true
+// marks the value as handled, so it isn't also written to the output.
+type PrintHook func(value Value) bool
+
+// OnPrint installs a hook that sees every printed value before it is
+// written. A nil hook removes it.
+func (vm *Vm) OnPrint(hook PrintHook) {
+	vm.onPrint = hook
+}
+
+// WithErrorOutput sends error messages and the output of eprint to w
+// instead of stderr.
+func WithErrorOutput(w io.Writer) Option {
+	return func(vm *Vm) {
+		vm.errOut = w
+	}
+}
+
+// WithTraceExecution makes the Vm write the stack and each instruction to
+// stderr before executing it.
+func WithTraceExecution() Option {
+	return func(vm *Vm) {
+		vm.traceExecution = true
+	}
+}
+
+// WithEval defines the eval native, which compiles and runs a string as
+// code. It is off by default so that a host running untrusted scripts
+// doesn't hand them a way to run code it never saw.
+func WithEval() Option {
+	return func(vm *Vm) {
+		vm.allowEval = true
+	}
+}
+
+// WithContext makes sleep() stop early with a runtime error once ctx is
+// done.
+func WithContext(ctx context.Context) Option {
+	return func(vm *Vm) {
+		vm.ctx = ctx
+	}
+}
+
+// Deterministic makes scripts reproducible: random() replays the sequence
+// for seed, and clock() and now() read a fake clock that advances by
+// exactly one millisecond on every reading. sleep() advances the fake
+// clock instead of waiting.
+func (vm *Vm) Deterministic(seed int64) {
+	vm.random = rand.New(rand.NewSource(seed))
+	fake := vm.startTime
+	vm.now = func() time.Time {
+		fake = fake.Add(time.Millisecond)
+		return fake
+	}
+	vm.sleep = func(d time.Duration) error {
+		fake = fake.Add(d)
+		return vm.ctx.Err()
+	}
+}
+
+// sleepFor waits for d or until the Vm's context is done, whichever
+// comes first.
+func (vm *Vm) sleepFor(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-vm.ctx.Done():
+		return vm.ctx.Err()
+	}
+}
+
+// Errors returns the compile or runtime errors reported by the last call
+// to Interpret, without stack traces.
+func (vm *Vm) Errors() []string {
+	return vm.errors
+}
+
+// SetMaxCallDepth limits how deeply calls may nest; a call beyond it is a
+// "Stack overflow." runtime error. Limits below 1 are ignored.
+func (vm *Vm) SetMaxCallDepth(depth int) {
+	if depth > 0 {
+		vm.maxCallDepth = depth
+	}
+}
+
+func (vm *Vm) SetDivision(division Division) {
+	vm.division = division
+}
+
+// SetLogLevel sets the least severe level the log native writes; less
+// severe messages are dropped. The default is LogInfo.
+func (vm *Vm) SetLogLevel(level LogLevel) {
+	vm.logLevel = level
+}
+
+// SetAssignmentCheck selects how scripts compiled from now on report an
+// assignment used as an if or while condition.
+func (vm *Vm) SetAssignmentCheck(check AssignmentCheck) {
+	vm.assignmentCheck = check
+}
+
+// SetMaxErrors sets how many compile errors are reported before the
+// compiler stops with a summary. A limit of 0 reports every error.
+func (vm *Vm) SetMaxErrors(max int) {
+	if max >= 0 {
+		vm.maxErrors = max
 	}
 }
 
+// EnableProfiling starts counting executed instructions per line and
+// opcode; the counts accumulate across calls to Interpret.
+func (vm *Vm) EnableProfiling() {
+	vm.profile = NewProfile()
+}
+
+// Profile returns the collected profile, or nil if profiling is disabled.
+func (vm *Vm) Profile() *Profile {
+	return vm.profile
+}
+
+// SetGlobal defines or overwrites a global variable, for seeding scripts
+// with values from Go.
+func (vm *Vm) SetGlobal(name string, value Value) {
+	vm.globals.define(StringValue(name), value)
+}
+
+// Global returns the value of a global variable and whether it exists.
+func (vm *Vm) Global(name string) (Value, bool) {
+	cell, ok := vm.globals.cells[StringValue(name)]
+	if !ok {
+		return nil, false
+	}
+	return cell.value, true
+}
+
+// ResetGlobals discards every global a script defined, leaving only the
+// natives.
+func (vm *Vm) ResetGlobals() {
+	vm.globals = NewGlobals()
+	vm.defineNatives()
+}
+
 func (vm *Vm) resetVm() {
-	vm.stack = make([]Value, 0)
-	vm.chunk = NewChunk()
-	vm.ip = 0
+	vm.truncateStack(0)
+	vm.frames = vm.frames[:0]
+	vm.openUpvalues = nil
+	vm.globalCells = map[*Chunk][]*globalCell{}
+	vm.nested = 0
+}
+
+// RunString runs source on a new Vm and returns everything it wrote,
+// printed values and errors alike, in the order it was written. It reads
+// no input and never exits the process, which suits hosts without a
+// terminal, such as a WebAssembly build. A compile error is returned as a
+// *CompileError; a runtime error's message is returned as err.
+func RunString(source string) (output string, err error) {
+	var out strings.Builder
+	vm := NewVm(WithOutput(&out), WithErrorOutput(&out), WithInput(strings.NewReader("")))
+	chunk, err := vm.Compile(source)
+	if err != nil {
+		return out.String(), err
+	}
+	if vm.RunCompiled(chunk) != InterpretOk {
+		return out.String(), errors.New(strings.Join(vm.Errors(), "\n"))
+	}
+	return out.String(), nil
 }
 
+// Interpret compiles and runs source. Each evaluation gets its own chunk,
+// frames and stack; globals are session state and survive across calls,
+// which the REPL relies on.
 func (vm *Vm) Interpret(source string) InterpretResult {
-	compiler := NewCompiler(source, vm.chunk)
-	if !compiler.compile() {
-		vm.resetVm()
+	chunk, err := vm.Compile(source)
+	if _, ok := err.(*CompileError); ok {
 		return InterpretCompileError
+	} else if err != nil {
+		return InterpretRuntimeError
 	}
-	return vm.run()
+	return vm.RunCompiled(chunk)
+}
+
+// Compile compiles source with the Vm's compiler settings without running
+// it. Errors are written to the error output and returned as a
+// *CompileError. A panic in the compiler itself is reported as an
+// internal error instead.
+func (vm *Vm) Compile(source string) (chunk *Chunk, err error) {
+	vm.errors = nil
+	defer func() {
+		if r := recover(); r != nil {
+			text := vm.internalError(r)
+			fmt.Fprintln(vm.errOut, text)
+			chunk, err = nil, errors.New(text)
+		}
+	}()
+
+	compiler := vm.newCompiler(source)
+	function, ok := compiler.compile()
+	if !ok {
+		vm.errors = compiler.errors
+		return nil, &CompileError{Errors: compiler.errors}
+	}
+	return function.chunk, nil
+}
+
+// newCompiler returns a compiler with the Vm's settings.
+func (vm *Vm) newCompiler(source string) *Compiler {
+	compiler := NewCompiler(source)
+	compiler.errOut = vm.errOut
+	compiler.assignmentCheck = vm.assignmentCheck
+	compiler.maxErrors = vm.maxErrors
+	return compiler
+}
+
+// RunCompiled runs a chunk from Compile or LoadChunk as a top-level
+// script. The same chunk may be run any number of times; each run starts
+// with an empty stack but sees the globals left by earlier runs unless
+// ResetGlobals is called in between.
+func (vm *Vm) RunCompiled(chunk *Chunk) (result InterpretResult) {
+	vm.errors = nil
+	function := NewFunctionValue()
+	function.chunk = chunk
+
+	defer func() {
+		if r := recover(); r != nil {
+			text := vm.internalError(r)
+			fmt.Fprintf(vm.errOut, "%s\n%s", text, vm.DumpState())
+			vm.resetVm()
+			result = InterpretRuntimeError
+		}
+	}()
+
+	vm.resetVm()
+	if vm.profile != nil {
+		vm.profile.addCode(function.chunk)
+	}
+	closure := NewClosureValue(function)
+	vm.push(closure)
+	vm.call(closure, 0)
+	return vm.run(0)
+}
+
+// internalError records a panic caused by a bug in the compiler or the VM
+// and returns its message.
+func (vm *Vm) internalError(r any) string {
+	text := fmt.Sprintf("internal error: %v", r)
+	vm.errors = append(vm.errors, text)
+	return text
 }
 
 func (vm *Vm) push(value Value) {
-	vm.stack = append(vm.stack, value)
+	if vm.stackTop == len(vm.stack) {
+		vm.growStack()
+	}
+	vm.stack[vm.stackTop] = value
+	vm.stackTop++
+}
+
+// growStack doubles the stack, up to maxStack.
+func (vm *Vm) growStack() {
+	if len(vm.stack) == vm.maxStack {
+		panic(stackOverflow{})
+	}
+	size := len(vm.stack) * 2
+	if size > vm.maxStack {
+		size = vm.maxStack
+	}
+	stack := make([]Value, size)
+	copy(stack, vm.stack)
+	vm.stack = stack
 }
 
+// stackUnderflow is raised by pop and peek when an instruction expects
+// more values than the stack holds; run turns it into a runtime error.
+type stackUnderflow struct{}
+
+// stackOverflow is raised by push when the stack is full; run turns it
+// into a runtime error.
+type stackOverflow struct{}
+
 func (vm *Vm) pop() Value {
-	value := vm.stack[len(vm.stack)-1]
-	vm.stack = vm.stack[:len(vm.stack)-1]
+	if vm.stackTop == 0 {
+		panic(stackUnderflow{})
+	}
+	vm.stackTop--
+	value := vm.stack[vm.stackTop]
+	vm.stack[vm.stackTop] = nil
 	return value
 }
 
+// truncateStack discards every value from top upwards. Discarded slots
+// are cleared so they don't keep their values alive for the Go garbage
+// collector.
+func (vm *Vm) truncateStack(top int) {
+	for i := top; i < vm.stackTop; i++ {
+		vm.stack[i] = nil
+	}
+	vm.stackTop = top
+}
+
 func (vm *Vm) peek(distance int) Value {
-	return vm.stack[len(vm.stack)-1-distance]
+	if distance >= vm.stackTop {
+		panic(stackUnderflow{})
+	}
+	return vm.stack[vm.stackTop-1-distance]
 }
 
-func (vm *Vm) run() InterpretResult {
+// run executes instructions until the frame count drops back to base,
+// which is zero for the top-level script.
+func (vm *Vm) run(base int) (result InterpretResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r.(type) {
+			case stackUnderflow:
+				vm.runtimeError("Internal error: stack underflow at line %d.", vm.currentLine())
+			case stackOverflow:
+				vm.runtimeError("Stack overflow.")
+			default:
+				panic(r)
+			}
+			result = InterpretRuntimeError
+		}
+	}()
+
 	for {
-		// Only enable in debug
-		vm.debugTraceExecution()
+		if vm.traceExecution {
+			vm.debugTraceExecution()
+		}
 
+		if vm.profile != nil {
+			frame := vm.frame()
+			vm.profile.record(frame.closure.function.chunk, frame.ip)
+		}
 		instruction := vm.readByte()
-		switch OpCode(instruction) {
+		switch op := OpCode(instruction); op {
 		case OpReturn:
 			{
-				return InterpretOk
+				result := vm.pop()
+				frame := vm.frame()
+				vm.closeUpvalues(frame.slots)
+				vm.frames = vm.frames[:len(vm.frames)-1]
+				if len(vm.frames) == 0 {
+					vm.pop()
+					return InterpretOk
+				}
+				vm.truncateStack(frame.slots)
+				vm.push(result)
+				if len(vm.frames) == base {
+					return InterpretOk
+				}
 			}
 		case OpConstant:
 			{
-				constant := vm.readConstant()
+				constant := vm.readConstant(false)
 				vm.push(constant)
 			}
+		case OpConstantLong:
+			{
+				vm.push(vm.readConstant(true))
+			}
+		case OpImmediate:
+			vm.push(IntValue(int8(vm.readByte())))
 		case OpNegate:
-			if _, isNumber := vm.peek(0).(NumberValue); !isNumber {
+			if !isNumber(vm.peek(0).Type()) {
 				vm.runtimeError("Operand must be a number.")
 				return InterpretRuntimeError
 			}
-			vm.push(-vm.pop().(NumberValue))
+			vm.push(negate(vm.pop()))
 		case OpAdd:
 			{
-				_, isBString := vm.peek(0).(StringValue)
-				_, isAString := vm.peek(1).(StringValue)
-				_, isBNumber := vm.peek(0).(NumberValue)
-				_, isANumber := vm.peek(1).(NumberValue)
-				if isAString && isBString {
+				bType, aType := vm.peek(0).Type(), vm.peek(1).Type()
+				if aType == TypeString && bType == TypeString {
 					b := vm.pop().(StringValue)
 					a := vm.pop().(StringValue)
 					vm.push(StringValue(a + b))
-				} else if isANumber && isBNumber {
-					vm.push(NumberValue(vm.pop().(NumberValue) + vm.pop().(NumberValue)))
+				} else if isNumber(aType) && isNumber(bType) {
+					b := vm.pop()
+					a := vm.pop()
+					vm.push(arithmetic(OpAdd, a, b))
+				} else if (aType == TypeString && isCoercible(bType)) || (bType == TypeString && isCoercible(aType)) {
+					b := vm.pop()
+					a := vm.pop()
+					vm.push(StringValue(vm.stringify(a) + vm.stringify(b)))
 				} else {
 					vm.runtimeError("Operands must be two numbers or two strings.")
 					return InterpretRuntimeError
 				}
 			}
-		case OpSubtract, OpMultiply, OpDivide, OpGreater, OpLess, OpGreaterEqual, OpLessEqual:
+		case OpConcat:
+			{
+				b, isBString := vm.peek(0).(StringValue)
+				a, isAString := vm.peek(1).(StringValue)
+				if !isAString || !isBString {
+					vm.runtimeError("Operands must be two strings.")
+					return InterpretRuntimeError
+				}
+				vm.pop()
+				vm.pop()
+				vm.push(a + b)
+			}
+		case OpSubtract, OpMultiply, OpDivide, OpModulo, OpExponent, OpGreater, OpLess, OpGreaterEqual, OpLessEqual:
 			{
-				_, isBNumber := vm.peek(0).(NumberValue)
-				_, isANumber := vm.peek(1).(NumberValue)
-				if !isANumber || !isBNumber {
+				if !isNumber(vm.peek(0).Type()) || !isNumber(vm.peek(1).Type()) {
 					vm.runtimeError("Operands must be numbers.")
 					return InterpretRuntimeError
 				}
-				b := vm.pop().(NumberValue)
-				a := vm.pop().(NumberValue)
-				switch OpCode(instruction) {
-				case OpSubtract:
-					vm.push(a - b)
-				case OpMultiply:
-					vm.push(a * b)
-				case OpDivide:
-					vm.push(a / b)
-				case OpGreater:
-					vm.push(BoolValue(a > b))
-				case OpLess:
-					vm.push(BoolValue(a < b))
-				case OpGreaterEqual:
-					vm.push(BoolValue(a >= b))
-				case OpLessEqual:
-					vm.push(BoolValue(a <= b))
+				b := vm.pop()
+				a := vm.pop()
+				isDivision := op == OpDivide || op == OpModulo
+				if isDivision && toFloat(b) == 0 && vm.division == DivisionChecked {
+					vm.runtimeError("Division by zero.")
+					return InterpretRuntimeError
+				}
+				switch op {
+				case OpGreater, OpLess, OpGreaterEqual, OpLessEqual:
+					vm.push(BoolValue(compareNumbers(op, a, b)))
+				default:
+					vm.push(arithmetic(op, a, b))
 				}
 			}
 		case OpNil:
-			vm.push(NilValue{})
+			vm.push(Nil)
 		case OpTrue:
 			vm.push(BoolValue(true))
 		case OpFalse:
 			vm.push(BoolValue(false))
 		case OpNot:
-			vm.push(BoolValue(!vm.pop().isTruthy()))
+			vm.push(BoolValue(!vm.isTruthy(vm.pop())))
 		case OpEqual:
 			{
 				b := vm.pop()
 				a := vm.pop()
-				vm.push(BoolValue(a == b))
+				vm.push(BoolValue(valuesEqual(a, b)))
 			}
 		case OpNotEqual:
 			{
 				b := vm.pop()
 				a := vm.pop()
-				vm.push(BoolValue(a != b))
+				vm.push(BoolValue(!valuesEqual(a, b)))
 			}
 		case OpPrint:
 			{
-				vm.pop().print()
-				fmt.Println()
+				value := vm.pop()
+				if vm.onPrint == nil || !vm.onPrint(value) {
+					fmt.Fprintln(vm.out, vm.stringify(value))
+				}
 			}
 		case OpPop:
 			vm.pop()
-		case OpDefineGlobal:
+		case OpDefineGlobal, OpDefineGlobalLong:
 			{
-				name := vm.readConstant().(StringValue)
-				vm.globals[name] = vm.pop()
+				name := vm.readConstant(op == OpDefineGlobalLong).(StringValue)
+				vm.globals.define(name, vm.pop())
 			}
-		case OpGetGlobal:
+		case OpGetGlobal, OpGetGlobalLong:
 			{
-				name := vm.readConstant().(StringValue)
-				if value, ok := vm.globals[name]; !ok {
-					vm.runtimeError("Undefined variable '%s'.", name)
+				index := vm.readIndex(op == OpGetGlobalLong)
+				frame := vm.frame()
+				chunk := frame.closure.function.chunk
+				cell := vm.globals.resolveGlobal(chunk, frame.globalCells, index)
+				if cell == nil {
+					vm.runtimeError("Undefined variable '%s'.", chunk.constants[index])
 					return InterpretRuntimeError
-				} else {
-					vm.push(value)
 				}
+				vm.push(cell.value)
 			}
-		case OpSetGlobal:
+		case OpSetGlobal, OpSetGlobalLong:
 			{
-				name := vm.readConstant().(StringValue)
-				if _, ok := vm.globals[name]; !ok {
-					vm.runtimeError("Undefined variable '%s'.", name)
+				index := vm.readIndex(op == OpSetGlobalLong)
+				frame := vm.frame()
+				chunk := frame.closure.function.chunk
+				cell := vm.globals.resolveGlobal(chunk, frame.globalCells, index)
+				if cell == nil {
+					vm.runtimeError("Undefined variable '%s'.", chunk.constants[index])
 					return InterpretRuntimeError
-				} else {
-					vm.globals[name] = vm.peek(0)
 				}
+				cell.value = vm.peek(0)
 			}
 		case OpGetLocal:
 			{
-				slot := vm.readByte()
-				vm.push(vm.stack[slot])
+				slot := int(vm.readByte())
+				vm.push(vm.stack[vm.frame().slots+slot])
 			}
 		case OpSetLocal:
 			{
-				slot := vm.readByte()
-				vm.stack[slot] = vm.peek(0)
+				slot := int(vm.readByte())
+				vm.stack[vm.frame().slots+slot] = vm.peek(0)
+			}
+		case OpGetLocalLong:
+			{
+				slot := vm.readShort()
+				vm.push(vm.stack[vm.frame().slots+slot])
+			}
+		case OpSetLocalLong:
+			{
+				slot := vm.readShort()
+				vm.stack[vm.frame().slots+slot] = vm.peek(0)
 			}
 		case OpJumpIfFalse:
 			{
 				offset := vm.readShort()
-				if !vm.peek(0).isTruthy() {
-					vm.ip += offset
+				if !vm.isTruthy(vm.peek(0)) {
+					vm.frame().ip += offset
 				}
 			}
 		case OpJump:
 			{
 				offset := vm.readShort()
-				vm.ip += offset
+				vm.frame().ip += offset
 			}
 		case OpLoop:
 			{
 				offset := vm.readShort()
-				vm.ip -= offset
+				vm.frame().ip -= offset
+			}
+		case OpCall:
+			{
+				argCount := int(vm.readByte())
+				if !vm.callValue(vm.peek(argCount), argCount) {
+					return InterpretRuntimeError
+				}
+			}
+		case OpClosure, OpClosureLong:
+			{
+				function := vm.readConstant(op == OpClosureLong).(*FunctionValue)
+				closure := NewClosureValue(function)
+				vm.push(closure)
+				for i := range closure.upvalues {
+					isLocal := vm.readByte()
+					index := int(vm.readByte())
+					if isLocal == 1 {
+						closure.upvalues[i] = vm.captureUpvalue(vm.frame().slots + index)
+					} else {
+						closure.upvalues[i] = vm.frame().closure.upvalues[index]
+					}
+				}
+			}
+		case OpGetUpvalue:
+			{
+				slot := vm.readByte()
+				upvalue := vm.frame().closure.upvalues[slot]
+				if upvalue.isOpen {
+					vm.push(vm.stack[upvalue.location])
+				} else {
+					vm.push(upvalue.closed)
+				}
+			}
+		case OpSetUpvalue:
+			{
+				slot := vm.readByte()
+				upvalue := vm.frame().closure.upvalues[slot]
+				if upvalue.isOpen {
+					vm.stack[upvalue.location] = vm.peek(0)
+				} else {
+					upvalue.closed = vm.peek(0)
+				}
+			}
+		case OpClass, OpClassLong:
+			vm.push(NewClassValue(string(vm.readConstant(op == OpClassLong).(StringValue))))
+		case OpGetProperty, OpGetPropertyLong:
+			{
+				instance, ok := vm.peek(0).(*InstanceValue)
+				if !ok {
+					vm.runtimeError("Only instances have properties.")
+					return InterpretRuntimeError
+				}
+				name := vm.readConstant(op == OpGetPropertyLong).(StringValue)
+				if value, ok := instance.fields[name]; ok {
+					vm.pop()
+					vm.push(value)
+				} else if !vm.bindMethod(instance.class, name) {
+					return InterpretRuntimeError
+				}
+			}
+		case OpSetProperty, OpSetPropertyLong:
+			{
+				instance, ok := vm.peek(1).(*InstanceValue)
+				if !ok {
+					vm.runtimeError("Only instances have fields.")
+					return InterpretRuntimeError
+				}
+				name := vm.readConstant(op == OpSetPropertyLong).(StringValue)
+				instance.fields[name] = vm.peek(0)
+				value := vm.pop()
+				vm.pop()
+				vm.push(value)
+			}
+		case OpMethod, OpMethodLong:
+			{
+				name := vm.readConstant(op == OpMethodLong).(StringValue)
+				class := vm.peek(1).(*ClassValue)
+				class.methods[name] = vm.pop().(*ClosureValue)
+			}
+		case OpInherit:
+			{
+				superclass, ok := vm.peek(1).(*ClassValue)
+				if !ok {
+					vm.runtimeError("Superclass must be a class.")
+					return InterpretRuntimeError
+				}
+				subclass := vm.peek(0).(*ClassValue)
+				for name, method := range superclass.methods {
+					subclass.methods[name] = method
+				}
+				vm.pop()
+			}
+		case OpGetSuper, OpGetSuperLong:
+			{
+				name := vm.readConstant(op == OpGetSuperLong).(StringValue)
+				superclass := vm.pop().(*ClassValue)
+				if !vm.bindMethod(superclass, name) {
+					return InterpretRuntimeError
+				}
+			}
+		case OpCloseUpvalue:
+			vm.closeUpvalues(vm.stackTop - 1)
+			vm.pop()
+		}
+	}
+}
+
+func (vm *Vm) frame() *CallFrame {
+	return &vm.frames[len(vm.frames)-1]
+}
+
+func (vm *Vm) callValue(callee Value, argCount int) bool {
+	switch callee := callee.(type) {
+	case *BoundMethodValue:
+		vm.stack[vm.stackTop-argCount-1] = callee.receiver
+		return vm.call(callee.method, argCount)
+	case *ClassValue:
+		vm.stack[vm.stackTop-argCount-1] = NewInstanceValue(callee)
+		if initializer, ok := callee.methods["init"]; ok {
+			// Check here so the error names the class rather than 'init'.
+			if argCount != initializer.function.arity {
+				vm.arityError(callee.name, initializer.function.arity, argCount)
+				return false
 			}
+			return vm.call(initializer, argCount)
+		}
+		if argCount != 0 {
+			vm.arityError(callee.name, 0, argCount)
+			return false
 		}
+		return true
+	case *ClosureValue:
+		return vm.call(callee, argCount)
+	case *NativeValue:
+		return vm.callNative(callee, argCount)
+	}
+	vm.runtimeError("Can only call functions and classes.")
+	return false
+}
+
+func (vm *Vm) callNative(native *NativeValue, argCount int) bool {
+	if argCount != native.arity {
+		vm.arityError(native.name, native.arity, argCount)
+		return false
+	}
+	args := vm.stack[vm.stackTop-argCount : vm.stackTop]
+	result, err := native.function(args)
+	if err != nil {
+		vm.runtimeError("%s", err)
+		return false
+	}
+	vm.truncateStack(vm.stackTop - argCount - 1)
+	vm.push(result)
+	return true
+}
+
+func (vm *Vm) call(closure *ClosureValue, argCount int) bool {
+	if argCount != closure.function.arity {
+		name := closure.function.name
+		if name == "" {
+			name = "script"
+		}
+		vm.arityError(name, closure.function.arity, argCount)
+		return false
+	}
+	if len(vm.frames) == vm.maxCallDepth {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+	chunk := closure.function.chunk
+	cells, ok := vm.globalCells[chunk]
+	if !ok {
+		cells = make([]*globalCell, len(chunk.constants))
+		vm.globalCells[chunk] = cells
+	}
+	vm.frames = append(vm.frames, CallFrame{
+		closure:     closure,
+		ip:          0,
+		slots:       vm.stackTop - argCount - 1,
+		globalCells: cells,
+	})
+	return true
+}
+
+// callNested calls callee from inside a native and runs it to
+// completion. A runtime error unwinds only the frames the call pushed and
+// is returned rather than reported, leaving the native to decide what to
+// do with it.
+func (vm *Vm) callNested(callee Value, args ...Value) (Value, error) {
+	base, top := len(vm.frames), vm.stackTop
+	vm.nested++
+	defer func() { vm.nested-- }()
+	vm.push(callee)
+	for _, arg := range args {
+		vm.push(arg)
+	}
+	ok := vm.callValue(callee, len(args))
+	if ok && len(vm.frames) > base {
+		ok = vm.run(base) == InterpretOk
+	}
+	if !ok {
+		vm.closeUpvalues(top)
+		vm.frames = vm.frames[:base]
+		vm.truncateStack(top)
+		return nil, errors.New(vm.nestedError)
+	}
+	return vm.pop(), nil
+}
+
+// arityError reports a call with the wrong number of arguments, naming
+// the callee.
+func (vm *Vm) arityError(name string, arity, argCount int) {
+	noun := "arguments"
+	if arity == 1 {
+		noun = "argument"
+	}
+	vm.runtimeError("Expected %d %s to '%s' but got %d.", arity, noun, name, argCount)
+}
+
+// bindMethod replaces the instance on top of the stack with its class's
+// method of the given name, bound to that instance.
+func (vm *Vm) bindMethod(class *ClassValue, name StringValue) bool {
+	method, ok := class.methods[name]
+	if !ok {
+		vm.runtimeError("Undefined property '%s'.", name)
+		return false
+	}
+	bound := NewBoundMethodValue(vm.peek(0), method)
+	vm.pop()
+	vm.push(bound)
+	return true
+}
+
+// captureUpvalue returns the open upvalue for a stack slot, creating it if
+// no closure has captured that slot yet. Open upvalues are kept sorted by
+// slot, highest first, so closeUpvalues can stop early.
+func (vm *Vm) captureUpvalue(location int) *RuntimeUpvalue {
+	var previous *RuntimeUpvalue
+	upvalue := vm.openUpvalues
+	for upvalue != nil && upvalue.location > location {
+		previous = upvalue
+		upvalue = upvalue.next
+	}
+	if upvalue != nil && upvalue.location == location {
+		return upvalue
+	}
+
+	created := &RuntimeUpvalue{location: location, isOpen: true, next: upvalue}
+	if previous == nil {
+		vm.openUpvalues = created
+	} else {
+		previous.next = created
+	}
+	return created
+}
+
+// closeUpvalues moves every captured variable at or above the given stack
+// slot off the stack and into its upvalue.
+func (vm *Vm) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.location >= last {
+		upvalue := vm.openUpvalues
+		upvalue.closed = vm.stack[upvalue.location]
+		upvalue.isOpen = false
+		vm.openUpvalues = upvalue.next
 	}
 }
 
@@ -212,29 +1011,101 @@ func (vm *Vm) readShort() int {
 }
 
 func (vm *Vm) readByte() byte {
-	byte := vm.chunk.code[vm.ip]
-	vm.ip += 1
+	frame := vm.frame()
+	byte := frame.closure.function.chunk.code[frame.ip]
+	frame.ip += 1
 	return byte
 }
 
-func (vm *Vm) readConstant() Value {
-	return vm.chunk.constants[vm.readByte()]
+// readIndex reads a constant index: one byte, or three for the _LONG
+// instructions.
+func (vm *Vm) readIndex(long bool) int {
+	if long {
+		return int(vm.readByte())<<16 | vm.readShort()
+	}
+	return int(vm.readByte())
+}
+
+func (vm *Vm) readConstant(long bool) Value {
+	return vm.frame().closure.function.chunk.constants[vm.readIndex(long)]
 }
 
+// currentLine is the source line of the instruction being executed.
+func (vm *Vm) currentLine() int {
+	frame := vm.frame()
+	return frame.closure.function.chunk.lines[frame.ip-1]
+}
+
+func (vm *Vm) isTruthy(value Value) bool {
+	if vm.truthiness == TruthinessLoose {
+		switch value := value.(type) {
+		case NumberValue:
+			return value != 0
+		case IntValue:
+			return value != 0
+		case StringValue:
+			return value != ""
+		}
+	}
+	return value.isTruthy()
+}
+
+// stringify renders a value the way print shows it, honoring the
+// display mode.
+func (vm *Vm) stringify(value Value) string {
+	text := value.String()
+	if _, ok := value.(NumberValue); ok && vm.displayMode == DisplayExact {
+		if !strings.ContainsAny(text, ".eIN") {
+			text += ".0"
+		}
+	}
+	return text
+}
+
+// isCoercible reports whether a value of the given type may be converted
+// to a string when added to one.
+func isCoercible(valueType ValueType) bool {
+	switch valueType {
+	case TypeNumber, TypeInt, TypeBool, TypeNil:
+		return true
+	default:
+		return false
+	}
+}
+
+// debugTraceExecution writes the stack and the next instruction to
+// stderr, keeping the trace apart from the program's own output.
 func (vm *Vm) debugTraceExecution() {
-	fmt.Print("          ")
-	for value := range vm.stack {
-		fmt.Print("[ ")
-		vm.stack[value].print()
-		fmt.Print(" ]")
+	fmt.Fprint(os.Stderr, "          ")
+	for value := range vm.stack[:vm.stackTop] {
+		fmt.Fprintf(os.Stderr, "[ %s ]", vm.stack[value])
 	}
-	fmt.Println()
-	vm.chunk.disassembleInstruction(vm.ip)
+	fmt.Fprintln(os.Stderr)
+	frame := vm.frame()
+	frame.closure.function.chunk.disassembleInstruction(os.Stderr, frame.ip)
 }
 
 func (vm *Vm) runtimeError(format string, args ...any) {
-	fmt.Fprintf(os.Stderr, format, args...)
-	fmt.Fprintln(os.Stderr)
-	fmt.Printf("[line %d] in script\n", vm.chunk.lines[vm.ip-1])
+	text := fmt.Sprintf(format, args...)
+	if vm.nested > 0 {
+		vm.nestedError = text
+		return
+	}
+	fmt.Fprintln(vm.errOut, text)
+	vm.errors = append(vm.errors, text)
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		if i == len(vm.frames)-1-traceFrames && i > traceFrames {
+			fmt.Fprintf(vm.errOut, "... %d more frames ...\n", i-traceFrames+1)
+			i = traceFrames - 1
+		}
+		frame := vm.frames[i]
+		function := frame.closure.function
+		line := function.chunk.lines[frame.ip-1]
+		if function.name == "" {
+			fmt.Fprintf(vm.errOut, "[line %d] in script\n", line)
+		} else {
+			fmt.Fprintf(vm.errOut, "[line %d] in %s()\n", line, function.name)
+		}
+	}
 	vm.resetVm()
 }
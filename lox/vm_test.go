@@ -0,0 +1,694 @@
+package lox
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// capture runs f and returns what it wrote to file, which is usually
+// os.Stderr.
+func capture(t *testing.T, file **os.File, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *file
+	*file = w
+	defer func() { *file = saved }()
+
+	captured := make(chan string)
+	go func() {
+		text, _ := io.ReadAll(r)
+		captured <- string(text)
+	}()
+	f()
+	w.Close()
+	return <-captured
+}
+
+func TestInterpretRecoversFromInternalPanic(t *testing.T) {
+	vm, _, errOut := newTestVm()
+	vm.defineNative("explode", 0, func(args []Value) (Value, error) {
+		panic("boom")
+	})
+	if result := vm.Interpret("explode();"); result != InterpretRuntimeError {
+		t.Fatalf("Interpret = %d, want InterpretRuntimeError", result)
+	}
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != "internal error: boom" {
+		t.Errorf("Errors() = %q, want the internal error", errors)
+	}
+	if !strings.Contains(errOut.String(), "== vm state ==") {
+		t.Errorf("error output has no state dump:\n%s", errOut)
+	}
+
+	// The Vm is left usable.
+	if result := vm.Interpret("var answer = 42;"); result != InterpretOk {
+		t.Fatalf("after recovering, Interpret = %d", result)
+	}
+	if answer := globalValue(vm, "answer"); answer != IntValue(42) {
+		t.Errorf("answer = %v, want 42", answer)
+	}
+}
+
+func TestStackUnderflowIsARuntimeError(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk *Chunk
+	}{
+		// Slot zero holds the script's closure, so the second pop
+		// underflows.
+		{"pop", chunkOf(byte(OpPop), byte(OpPop), byte(OpNil), byte(OpReturn))},
+		{"peek", chunkOf(byte(OpPop), byte(OpNegate), byte(OpNil), byte(OpReturn))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm, _, _ := newTestVm()
+			if result := runChunk(vm, test.chunk); result != InterpretRuntimeError {
+				t.Errorf("run() = %d, want InterpretRuntimeError", result)
+			}
+			want := "Internal error: stack underflow at line 1."
+			if errors := vm.Errors(); len(errors) != 1 || errors[0] != want {
+				t.Errorf("reported %q, want %q", errors, want)
+			}
+		})
+	}
+}
+
+func TestDisplayMode(t *testing.T) {
+	tests := []struct {
+		mode  DisplayMode
+		value NumberValue
+		want  string
+	}{
+		{DisplayCompact, 3, "3"},
+		{DisplayExact, 3, "3.0"},
+		{DisplayCompact, 2.5, "2.5"},
+		{DisplayExact, 2.5, "2.5"},
+		{DisplayExact, 0, "0.0"},
+		{DisplayExact, 1e21, "1e+21"},
+	}
+	for _, test := range tests {
+		vm := NewVm()
+		vm.SetDisplayMode(test.mode)
+		if printed := vm.stringify(test.value); printed != test.want {
+			t.Errorf("mode %d printed %v as %q, want %q", test.mode, float64(test.value), printed, test.want)
+		}
+	}
+
+	vm := NewVm()
+	if printed := vm.stringify(NumberValue(3)); printed != "3.0" {
+		t.Errorf("by default, printed 3.0 as %q", printed)
+	}
+}
+
+func TestLocalsPastSlot255(t *testing.T) {
+	var source strings.Builder
+	source.WriteString("var low; var high; var sum;\n{\n")
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&source, "var l%d;\n", i)
+	}
+	// Only a few constants, so that the one-byte constant indices last.
+	source.WriteString("l1 = 1; l255 = 255; l298 = 298; l299 = 299;\n")
+	source.WriteString("l299 = l299 + 1000;\nl256 = l1;\nlow = l255; high = l299; sum = l256 + l298;\n}\n")
+
+	chunk := mustCompile(t, source.String())
+	if countOp(chunk, OpGetLocalLong) != 5 || countOp(chunk, OpSetLocalLong) != 5 {
+		t.Errorf("compiled %d OP_GET_LOCAL_LONG and %d OP_SET_LOCAL_LONG, want 5 of each",
+			countOp(chunk, OpGetLocalLong), countOp(chunk, OpSetLocalLong))
+	}
+
+	vm := NewVm()
+	if result := vm.Interpret(source.String()); result != InterpretOk {
+		t.Fatalf("Interpret = %d", result)
+	}
+	want := map[StringValue]Value{"low": IntValue(255), "high": IntValue(1299), "sum": IntValue(299)}
+	for name, value := range want {
+		if globalValue(vm, name) != value {
+			t.Errorf("%s = %v, want %v", name, globalValue(vm, name), value)
+		}
+	}
+}
+
+// newTestVm returns a Vm whose print output and error output are
+// captured.
+func newTestVm(options ...Option) (*Vm, *strings.Builder, *strings.Builder) {
+	var out, errOut strings.Builder
+	options = append([]Option{WithOutput(&out), WithErrorOutput(&errOut)}, options...)
+	return NewVm(options...), &out, &errOut
+}
+
+// expectOutput runs source on a fresh Vm and checks that it succeeds and
+// prints want.
+func expectOutput(t *testing.T, source, want string) {
+	t.Helper()
+	vm, out, errOut := newTestVm()
+	if result := vm.Interpret(source); result != InterpretOk {
+		t.Fatalf("Interpret(%q) = %d, want InterpretOk; errors:\n%s", source, result, errOut)
+	}
+	if out.String() != want {
+		t.Errorf("Interpret(%q) printed %q, want %q", source, out.String(), want)
+	}
+}
+
+// expectRuntimeError runs source on a fresh Vm and checks that it fails
+// with a runtime error whose message is want.
+func expectRuntimeError(t *testing.T, source, want string) {
+	t.Helper()
+	vm, _, errOut := newTestVm()
+	if result := vm.Interpret(source); result != InterpretRuntimeError {
+		t.Fatalf("Interpret(%q) = %d, want InterpretRuntimeError; errors:\n%s", source, result, errOut)
+	}
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != want {
+		t.Errorf("Interpret(%q) reported %q, want %q", source, errors, want)
+	}
+}
+
+// runChunk runs raw bytecode as the script's code on vm.
+func runChunk(vm *Vm, chunk *Chunk) InterpretResult {
+	function := NewFunctionValue()
+	function.chunk = chunk
+	closure := NewClosureValue(function)
+	vm.push(closure)
+	vm.call(closure, 0)
+	return vm.run(0)
+}
+
+// globalsAfter runs source on a fresh Vm and returns its globals.
+func globalsAfter(t *testing.T, source string) map[StringValue]Value {
+	t.Helper()
+	vm := NewVm()
+	if result := vm.Interpret(source); result != InterpretOk {
+		t.Fatalf("Interpret(%q) = %d, want InterpretOk", source, result)
+	}
+	values := make(map[StringValue]Value)
+	for name, cell := range vm.globals.cells {
+		values[name] = cell.value
+	}
+	return values
+}
+
+// globalValue returns the value of a global, or nil if it isn't defined.
+func globalValue(vm *Vm, name StringValue) Value {
+	if cell, ok := vm.globals.cells[name]; ok {
+		return cell.value
+	}
+	return nil
+}
+
+func TestTruthiness(t *testing.T) {
+	const source = `
+		var zero = !0;
+		var empty = !"";
+		var none = !nil;
+		var no = !false;
+		var one = !1;
+		var text = !"a";
+		var branch = "else";
+		if (0) branch = "then";
+		var loops = 0;
+		while ("" and loops < 3) loops = loops + 1;
+		var either = 0 or "fallback";
+	`
+	tests := []struct {
+		truthiness Truthiness
+		want       map[StringValue]Value
+	}{
+		{TruthinessStrict, map[StringValue]Value{
+			"zero": BoolValue(false), "empty": BoolValue(false), "none": BoolValue(true), "no": BoolValue(true),
+			"one": BoolValue(false), "text": BoolValue(false), "branch": StringValue("then"), "loops": IntValue(3),
+			"either": IntValue(0),
+		}},
+		{TruthinessLoose, map[StringValue]Value{
+			"zero": BoolValue(true), "empty": BoolValue(true), "none": BoolValue(true), "no": BoolValue(true),
+			"one": BoolValue(false), "text": BoolValue(false), "branch": StringValue("else"), "loops": IntValue(0),
+			"either": StringValue("fallback"),
+		}},
+	}
+	for _, test := range tests {
+		vm := NewVm()
+		vm.SetTruthiness(test.truthiness)
+		if result := vm.Interpret(source); result != InterpretOk {
+			t.Fatalf("truthiness %d: Interpret = %d", test.truthiness, result)
+		}
+		for name, value := range test.want {
+			if globalValue(vm, name) != value {
+				t.Errorf("truthiness %d: %s = %v, want %v", test.truthiness, name, globalValue(vm, name), value)
+			}
+		}
+	}
+}
+
+func TestEachInterpretStartsAFreshChunk(t *testing.T) {
+	vm, _, _ := newTestVm()
+	for _, line := range []string{"var x = 1;", "x = x + 1;", "var y = x * 10;"} {
+		if result := vm.Interpret(line); result != InterpretOk {
+			t.Fatalf("Interpret(%q) = %d", line, result)
+		}
+	}
+	// A compile error leaves the session's globals alone.
+	if result := vm.Interpret("var = ;"); result != InterpretCompileError {
+		t.Fatalf("Interpret = %d, want InterpretCompileError", result)
+	}
+	if result := vm.Interpret("var z = x + y;"); result != InterpretOk {
+		t.Fatalf("after the error, Interpret = %d", result)
+	}
+	if globalValue(vm, "z") != IntValue(22) || vm.stackTop != 0 {
+		t.Errorf("z = %v with %d values on the stack, want 22 and an empty stack", globalValue(vm, "z"), vm.stackTop)
+	}
+}
+
+func TestAddingToAStringCoerces(t *testing.T) {
+	globals := globalsAfter(t, `
+		var count = "count: " + 5;
+		var flag = true + "!";
+		var none = "is " + nil;
+		var half = 0.5 + "";
+		var sum = 1 + 2;
+	`)
+	want := map[StringValue]Value{"count": StringValue("count: 5"), "flag": StringValue("true!"),
+		"none": StringValue("is nil"), "half": StringValue("0.5"), "sum": IntValue(3)}
+	for name, value := range want {
+		if globals[name] != value {
+			t.Errorf("%s = %v, want %v", name, globals[name], value)
+		}
+	}
+}
+
+func TestRecursiveFunction(t *testing.T) {
+	globals := globalsAfter(t, `
+		fun fib(n) { if (n < 2) return n; return fib(n - 1) + fib(n - 2); }
+		var result = fib(15);
+	`)
+	if globals["result"] != IntValue(610) {
+		t.Errorf("fib(15) = %v, want 610", globals["result"])
+	}
+}
+
+func TestReturnedClosureKeepsItsCapturedLocal(t *testing.T) {
+	globals := globalsAfter(t, `
+		fun makeCounter() {
+			var count = 0;
+			fun increment() {
+				count = count + 1;
+				return count;
+			}
+			return increment;
+		}
+		fun clobber() {
+			var a = 100;
+			var b = 200;
+			return a + b;
+		}
+		var counter = makeCounter();
+		counter();
+		clobber();
+		var result = counter();
+	`)
+	if globals["result"] != IntValue(2) {
+		t.Errorf("result = %v, want 2", globals["result"])
+	}
+}
+
+func TestInfiniteRecursionOverflows(t *testing.T) {
+	expectRuntimeError(t, "fun f() { return f(); } f();", "Stack overflow.")
+
+	// With a small stack, the values on it run out before the frames do.
+	vm, _, _ := newTestVm(WithMaxStack(300))
+	source := "fun f(a, b, c, d) { return f(a, b, c, d); } f(1, 2, 3, 4);"
+	if result := vm.Interpret(source); result != InterpretRuntimeError {
+		t.Fatalf("Interpret = %d, want InterpretRuntimeError", result)
+	}
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != "Stack overflow." {
+		t.Errorf("Errors() = %q, want the overflow", errors)
+	}
+	if len(vm.frames) != 0 || vm.stackTop != 0 {
+		t.Errorf("left %d frames and %d values behind", len(vm.frames), vm.stackTop)
+	}
+	if result := vm.Interpret("var after = 1;"); result != InterpretOk || globalValue(vm, "after") != IntValue(1) {
+		t.Errorf("after overflowing, Interpret = %d", result)
+	}
+}
+
+func TestReplLinesShareGlobals(t *testing.T) {
+	vm, out, _ := newTestVm()
+	for _, line := range []string{"var x = 1;", "print x;"} {
+		if result := vm.Interpret(line); result != InterpretOk {
+			t.Errorf("Interpret(%q) = %d", line, result)
+		}
+	}
+	if out.String() != "1\n" {
+		t.Errorf("printed %q, want %q", out, "1\n")
+	}
+	if len(vm.frames) != 0 || vm.stackTop != 0 {
+		t.Errorf("left %d frames and %d values behind", len(vm.frames), vm.stackTop)
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	vm, _, errOut := newTestVm()
+	vm.SetMaxCallDepth(50)
+	source := "var depth = 0;\nfun f() {\n  depth = depth + 1;\n  f();\n}\nf();"
+	if result := vm.Interpret(source); result != InterpretRuntimeError {
+		t.Fatalf("Interpret = %d, want InterpretRuntimeError", result)
+	}
+	// The script's own frame counts toward the limit.
+	if depth := globalValue(vm, "depth"); depth != IntValue(49) {
+		t.Errorf("depth = %v, want 49", depth)
+	}
+
+	errors := errOut.String()
+	lines := strings.Split(strings.TrimSuffix(errors, "\n"), "\n")
+	want := []string{"Stack overflow."}
+	for i := 0; i < 10; i++ {
+		want = append(want, "[line 4] in f()")
+	}
+	want = append(want, "... 30 more frames ...")
+	for i := 0; i < 9; i++ {
+		want = append(want, "[line 4] in f()")
+	}
+	want = append(want, "[line 6] in script")
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("stack trace =\n%s\nwant\n%s", errors, strings.Join(want, "\n"))
+	}
+}
+
+func TestProgramsWithoutStatements(t *testing.T) {
+	for _, source := range []string{"", "   \n\t\r\n", "// just a comment", "// one\n\n// two\n"} {
+		vm, out, _ := newTestVm()
+		if result := vm.Interpret(source); result != InterpretOk || len(vm.Errors()) != 0 || out.Len() != 0 {
+			t.Errorf("Interpret(%q) = %d with errors %q and output %q", source, result, vm.Errors(), out)
+		}
+		chunk := mustCompile(t, source)
+		if ops := opcodes(chunk); len(ops) != 2 || ops[0] != OpNil || ops[1] != OpReturn {
+			t.Errorf("%q compiled to %v, want a lone return", source, ops)
+		}
+	}
+}
+
+func TestSourceEndingMidToken(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"1 /", "[line 1, col 4] Error at end: Expect expression."},
+		{"print 1.", "[line 1, col 9] Error at end: Expect property name after '.'."},
+	}
+	for _, test := range tests {
+		vm, _, _ := newTestVm()
+		if result := vm.Interpret(test.source); result != InterpretCompileError {
+			t.Errorf("Interpret(%q) = %d, want InterpretCompileError", test.source, result)
+		}
+		if errors := vm.Errors(); len(errors) == 0 || errors[0] != test.want {
+			t.Errorf("Interpret(%q) reported %q, want %q first", test.source, errors, test.want)
+		}
+	}
+}
+
+func TestCompileOnceRunMany(t *testing.T) {
+	vm, out, _ := newTestVm()
+	chunk, err := vm.Compile("var doubled = n * 2; print doubled;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int64{1, 2, 3} {
+		vm.SetGlobal("n", IntValue(n))
+		if result := vm.RunCompiled(chunk); result != InterpretOk {
+			t.Fatalf("RunCompiled = %d; errors %q", result, vm.Errors())
+		}
+	}
+	if out.String() != "2\n4\n6\n" {
+		t.Errorf("printed %q, want %q", out, "2\n4\n6\n")
+	}
+	if value, ok := vm.Global("doubled"); !ok || value != IntValue(6) {
+		t.Errorf("Global(doubled) = %v, %v", value, ok)
+	}
+
+	vm.ResetGlobals()
+	if _, ok := vm.Global("doubled"); ok {
+		t.Error("ResetGlobals kept a script's global")
+	}
+	if _, ok := vm.Global("clock"); !ok {
+		t.Error("ResetGlobals dropped the natives")
+	}
+	if result := vm.RunCompiled(chunk); result != InterpretRuntimeError {
+		t.Errorf("without n, RunCompiled = %d", result)
+	}
+}
+
+func TestVmCompileUsesTheVmSettings(t *testing.T) {
+	vm, _, errOut := newTestVm()
+	vm.SetAssignmentCheck(AssignmentCheckError)
+	if _, err := vm.Compile("var x; if (x = 1) {}"); err == nil {
+		t.Error("Compile() ignored the assignment check")
+	}
+	if len(vm.Errors()) != 1 || !strings.Contains(errOut.String(), "Assignment used as a condition") {
+		t.Errorf("Errors() = %q with error output %q", vm.Errors(), errOut)
+	}
+}
+
+func TestStackGrowsPastItsInitialSize(t *testing.T) {
+	// Each call leaves its argument and the callee on the stack, so
+	// recursing 500 deep needs about 1000 slots.
+	vm, out, errOut := newTestVm()
+	source := "fun depth(n) { if (n == 0) return 0; return 1 + depth(n - 1); } print depth(500);"
+	if result := vm.Interpret(source); result != InterpretOk {
+		t.Fatalf("Interpret = %d; errors:\n%s", result, errOut)
+	}
+	if out.String() != "500\n" {
+		t.Errorf("printed %q, want %q", out, "500\n")
+	}
+	if len(vm.stack) <= initialStack {
+		t.Errorf("stack has %d slots, want it to have grown past %d", len(vm.stack), initialStack)
+	}
+}
+
+func TestStackGrowthStopsAtTheLimit(t *testing.T) {
+	vm, _, _ := newTestVm(WithMaxStack(600))
+	vm.Interpret("fun depth(n) { if (n == 0) return 0; return 1 + depth(n - 1); } depth(500);")
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != "Stack overflow." {
+		t.Errorf("Errors() = %q, want the overflow", errors)
+	}
+	if len(vm.stack) != 600 {
+		t.Errorf("stack has %d slots, want the limit of 600", len(vm.stack))
+	}
+}
+
+func TestDroppedValuesAreCollected(t *testing.T) {
+	var freed atomic.Int32
+	vm, _, errOut := newTestVm()
+	vm.defineNative("track", 1, func(args []Value) (Value, error) {
+		runtime.SetFinalizer(args[0].(*InstanceValue), func(*InstanceValue) { freed.Add(1) })
+		return args[0], nil
+	})
+	// collect(n) runs the Go collector until n tracked instances have been
+	// finalized, or gives up after a while, and returns how many were.
+	vm.defineNative("collect", 1, func(args []Value) (Value, error) {
+		want := int32(args[0].(IntValue))
+		for deadline := time.Now().Add(time.Second); freed.Load() < want && time.Now().Before(deadline); {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		return NumberValue(freed.Load()), nil
+	})
+	// Each dropped instance sits in a slot of drop's frame, above anything
+	// the script uses afterwards, so only clearing it on return lets it go.
+	result := vm.Interpret(`
+		class Box {}
+		var kept = track(Box());
+		fun drop() {
+			var a = 1;
+			var b = 2;
+			track(Box());
+		}
+		for (var i = 0; i < 10; i = i + 1) drop();
+		var freed = collect(10);
+	`)
+	if result != InterpretOk {
+		t.Fatalf("Interpret = %d; errors:\n%s", result, errOut)
+	}
+	if got := globalValue(vm, "freed"); got != NumberValue(10) {
+		t.Errorf("%v of the 10 dropped instances were collected", got)
+	}
+	if kept := globalValue(vm, "kept"); kept == nil || kept.Type() != TypeInstance {
+		t.Errorf("kept = %v, want the instance", kept)
+	}
+}
+
+func TestMemoryStaysBounded(t *testing.T) {
+	// Every iteration creates a 64KB string that is garbage by the next
+	// one; the heap is sampled every 500 iterations.
+	var peak uint64
+	vm, _, _ := newTestVm()
+	vm.defineNative("sample", 0, func(args []Value) (Value, error) {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > peak {
+			peak = stats.HeapAlloc
+		}
+		return Nil, nil
+	})
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	result := vm.Interpret(`
+		var big = "x";
+		for (var i = 0; i < 16; i = i + 1) big = big + big;
+		for (var i = 0; i < 5000; i = i + 1) {
+			var s = big + i;
+			if (i % 500 == 0) sample();
+		}
+	`)
+	if result != InterpretOk {
+		t.Fatalf("Interpret = %d", result)
+	}
+	// The script allocated over 300MB in total.
+	if growth := int64(peak) - int64(before.HeapAlloc); growth > 4<<20 {
+		t.Errorf("heap grew by %d bytes while running", growth)
+	}
+}
+
+func TestOnPrintSeesPrintedValues(t *testing.T) {
+	vm, out, _ := newTestVm()
+	var values []Value
+	vm.OnPrint(func(value Value) bool {
+		values = append(values, value)
+		return false
+	})
+	if result := vm.Interpret(`print 1; print 2.5; print "three"; print nil; print true;`); result != InterpretOk {
+		t.Fatalf("Interpret = %d", result)
+	}
+	want := []Value{IntValue(1), NumberValue(2.5), StringValue("three"), Nil, BoolValue(true)}
+	if len(values) != len(want) {
+		t.Fatalf("hook saw %d values, want %d", len(values), len(want))
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Errorf("value %d is %#v, want %#v", i, values[i], want[i])
+		}
+	}
+	// Values the hook doesn't handle are still printed.
+	if out.String() != "1\n2.5\nthree\nnil\ntrue\n" {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestOnPrintCanHandleValues(t *testing.T) {
+	vm, out, _ := newTestVm()
+	var handled []Value
+	vm.OnPrint(func(value Value) bool {
+		if _, ok := value.(StringValue); ok {
+			handled = append(handled, value)
+			return true
+		}
+		return false
+	})
+	vm.Interpret(`print "a"; print 1; print "b";`)
+	if out.String() != "1\n" {
+		t.Errorf("printed %q, want only the number", out)
+	}
+	if len(handled) != 2 || handled[0] != StringValue("a") || handled[1] != StringValue("b") {
+		t.Errorf("hook handled %#v", handled)
+	}
+
+	// Removing the hook prints everything again.
+	out.Reset()
+	vm.OnPrint(nil)
+	vm.Interpret(`print "c";`)
+	if out.String() != "c\n" {
+		t.Errorf("after removing the hook, printed %q", out)
+	}
+}
+
+func TestPrintUsesTheDisplayMode(t *testing.T) {
+	const source = "print 3.0; print 6 / 4 * 2; print 3; print 2.5;"
+	tests := []struct {
+		mode DisplayMode
+		want string
+	}{
+		{DisplayExact, "3.0\n3.0\n3\n2.5\n"},
+		{DisplayCompact, "3\n3\n3\n2.5\n"},
+	}
+	for _, test := range tests {
+		vm, out, _ := newTestVm()
+		vm.SetDisplayMode(test.mode)
+		vm.Interpret(source)
+		if out.String() != test.want {
+			t.Errorf("mode %d printed %q, want %q", test.mode, out, test.want)
+		}
+	}
+
+	// Scripts keep whole floats distinct from integers unless asked not to.
+	expectOutput(t, source, "3.0\n3.0\n3\n2.5\n")
+}
+
+func TestArityErrorsNameTheCallee(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"fun add(a, b) { return a + b; } add(1);", "Expected 2 arguments to 'add' but got 1."},
+		{"fun add(a, b) { return a + b; } add(1, 2, 3);", "Expected 2 arguments to 'add' but got 3."},
+		{"class Box { init(value) {} } Box();", "Expected 1 argument to 'Box' but got 0."},
+		{"class Box { init(value) {} } Box(1).init();", "Expected 1 argument to 'init' but got 0."},
+		{"class Point {} Point(1, 2);", "Expected 0 arguments to 'Point' but got 2."},
+		{"class Box { get() {} } Box().get(1);", "Expected 0 arguments to 'get' but got 1."},
+		{"len();", "Expected 1 argument to 'len' but got 0."},
+		{"clock(1);", "Expected 0 arguments to 'clock' but got 1."},
+	}
+	for _, test := range tests {
+		expectRuntimeError(t, test.source, test.want)
+	}
+}
+
+func TestCompileRecoversFromInternalPanic(t *testing.T) {
+	saved := rules[TokenNumber]
+	defer func() { rules[TokenNumber] = saved }()
+	rules[TokenNumber].prefix = func(*Compiler, bool) { panic("broken number rule") }
+
+	vm, _, errOut := newTestVm()
+	if _, err := vm.Compile("print 1;"); err == nil || err.Error() != "internal error: broken number rule" {
+		t.Errorf("Compile() = %v, want the internal error", err)
+	}
+	if result := vm.Interpret("print 1;"); result != InterpretRuntimeError {
+		t.Errorf("Interpret = %d, want InterpretRuntimeError", result)
+	}
+	if errors := vm.Errors(); len(errors) != 1 || errors[0] != "internal error: broken number rule" {
+		t.Errorf("Errors() = %q", errors)
+	}
+	if !strings.Contains(errOut.String(), "internal error: broken number rule\n") {
+		t.Errorf("error output is %q", errOut)
+	}
+}
+
+func TestRunString(t *testing.T) {
+	output, err := RunString(`print "one"; eprint("two"); print 1 + nil;`)
+	want := "one\ntwo\nOperands must be two numbers or two strings.\n[line 1] in script\n"
+	if output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+	if err == nil || err.Error() != "Operands must be two numbers or two strings." {
+		t.Errorf("err = %v, want the runtime error", err)
+	}
+
+	output, err = RunString("print read_line();")
+	if output != "nil\n" || err != nil {
+		t.Errorf("reading input gave %q, %v; want nil, no error", output, err)
+	}
+
+	output, err = RunString("print 1 +;")
+	if _, ok := err.(*CompileError); !ok {
+		t.Errorf("err = %v, want a *CompileError", err)
+	}
+	if !strings.Contains(output, "Error at ';': Expect expression.") {
+		t.Errorf("output = %q, want the compile error", output)
+	}
+}
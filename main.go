@@ -5,26 +5,51 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/jhonnatangomes/golox/lox"
 )
 
+var (
+	compactNumbers = flag.Bool("compact", false, "print whole floats without a trailing .0 when running a script")
+	profile        = flag.Bool("profile", false, "report the hottest lines and opcodes to stderr after running a script")
+	dumpAST        = flag.Bool("ast", false, "print the syntax tree of a script instead of running it")
+	trace          = flag.Bool("trace", false, "print the stack and each instruction to stderr as it executes")
+	maxErrors      = flag.Int("max-errors", lox.DefaultMaxErrors, "stop compiling after this many errors, or 0 for no limit")
+	allowEval      = flag.Bool("eval", false, "define the eval native, which runs a string as code")
+)
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
 	if len(args) == 0 {
 		repl()
-	} else if len(args) == 1 {
+	} else if len(args) == 1 && args[0] != "" {
 		runFile(args[0])
+	} else if len(args) == 2 && args[0] == "stats" && args[1] != "" {
+		printStats(args[1])
+	} else if len(args) == 2 && args[0] == "cover" && args[1] != "" {
+		printCoverage(args[1])
+	} else if len(args) == 2 && args[0] == "compile" && args[1] != "" {
+		compileFile(args[1])
+	} else if len(args) == 2 && args[0] == "run" && args[1] != "" {
+		runCompiled(args[1])
 	} else {
-		fmt.Fprintf(os.Stderr, "Usage: golox [path]\n")
-		os.Exit(64)
+		usage()
 	}
 }
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: golox [path]\n       golox stats path\n       golox cover path\n       golox compile path\n       golox run path.loxc\n")
+	os.Exit(64)
+}
+
 func repl() {
-	vm := lox.NewVm()
+	// The Vm shares the reader so read_line and the prompt don't steal
+	// input from each other.
 	reader := bufio.NewReader(os.Stdin)
+	vm := newVm(lox.WithInput(reader))
+	vm.SetDisplayMode(lox.DisplayCompact)
 	for {
 		fmt.Print("> ")
 		input, err := reader.ReadString('\n')
@@ -37,9 +62,22 @@ func repl() {
 }
 
 func runFile(path string) {
-	vm := lox.NewVm()
+	if *dumpAST {
+		printAST(path)
+		return
+	}
+	vm := newVm()
+	if *compactNumbers {
+		vm.SetDisplayMode(lox.DisplayCompact)
+	}
+	if *profile {
+		vm.EnableProfiling()
+	}
 	source := readFile(path)
 	result := vm.Interpret(source)
+	if *profile {
+		vm.Profile().WriteReport(os.Stderr, 10)
+	}
 
 	if result == lox.InterpretCompileError {
 		os.Exit(65)
@@ -49,7 +87,102 @@ func runFile(path string) {
 	}
 }
 
+func printAST(path string) {
+	node, err := lox.ParseAST(readFile(path))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(65)
+	}
+	fmt.Println(node)
+}
+
+func printStats(path string) {
+	chunk, err := newVm().Compile(readFile(path))
+	if err != nil {
+		os.Exit(65)
+	}
+	chunk.Stats().WriteReport(os.Stdout)
+}
+
+// compileFile writes the compiled bytecode of a script next to it, with
+// a .loxc extension.
+func compileFile(path string) {
+	chunk, err := newVm().Compile(readFile(path))
+	if err != nil {
+		os.Exit(65)
+	}
+	out := strings.TrimSuffix(path, ".lox") + ".loxc"
+	file, err := os.Create(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write file %s\n", out)
+		os.Exit(74)
+	}
+	defer file.Close()
+	if err := chunk.Serialize(file); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write file %s: %v\n", out, err)
+		os.Exit(74)
+	}
+}
+
+// runCompiled runs bytecode written by compileFile.
+func runCompiled(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read file %s\n", path)
+		os.Exit(74)
+	}
+	defer file.Close()
+	chunk, err := lox.LoadChunk(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load %s: %v\n", path, err)
+		os.Exit(65)
+	}
+	vm := newVm()
+	if *compactNumbers {
+		vm.SetDisplayMode(lox.DisplayCompact)
+	}
+	if vm.RunCompiled(chunk) == lox.InterpretRuntimeError {
+		os.Exit(70)
+	}
+}
+
+// printCoverage runs a script and then lists its source annotated with
+// how often each line ran.
+func printCoverage(path string) {
+	vm := newVm()
+	vm.EnableProfiling()
+	source := readFile(path)
+	result := vm.Interpret(source)
+	vm.Profile().WriteCoverage(os.Stdout, source)
+
+	if result == lox.InterpretCompileError {
+		os.Exit(65)
+	}
+	if result == lox.InterpretRuntimeError {
+		os.Exit(70)
+	}
+}
+
+// newVm creates a Vm configured by the command-line flags shared by every
+// mode, followed by any extra options.
+func newVm(extra ...lox.Option) *lox.Vm {
+	options := extra
+	if *trace {
+		options = append(options, lox.WithTraceExecution())
+	}
+	if *allowEval {
+		options = append(options, lox.WithEval())
+	}
+	vm := lox.NewVm(options...)
+	vm.SetMaxErrors(*maxErrors)
+	return vm
+}
+
 func readFile(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		fmt.Fprintf(os.Stderr, "Could not read file %s: it is a directory\n", path)
+		os.Exit(74)
+	}
 	file, err := os.ReadFile(path)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not read file %s\n", path)